@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+)
+
+var errNoQuorum = errors.New("not enough sources agree")
+
+// sourceSet fetches every source of a feed concurrently and reduces the
+// answers to a single median price.
+type sourceSet struct {
+	sources    []PriceSource
+	outlierBps int64 // max distance from the median in basis points, 0 disables
+	quorum     int   // min number of surviving observations
+	timeout    time.Duration
+}
+
+// aggregateReport is the outcome of one sourceSet round.
+type aggregateReport struct {
+	Median   *big.Rat
+	Accepted []*Observation
+	Rejected []*Observation
+	Errors   map[string]error
+	Latency  map[string]time.Duration // fetch time per source
+}
+
+func newSourceSet(coin config.Coins) (*sourceSet, error) {
+	set := &sourceSet{
+		outlierBps: coin.OutlierBps,
+		quorum:     coin.Quorum,
+		timeout:    30 * time.Second,
+	}
+	seen := make(map[string]bool)
+	for _, src := range coin.SourceList() {
+		if seen[src.ID()] {
+			return nil, fmt.Errorf("duplicate source id %q", src.ID())
+		}
+		seen[src.ID()] = true
+		source, err := newPriceSource(src)
+		if err != nil {
+			return nil, err
+		}
+		set.sources = append(set.sources, source)
+	}
+	if set.quorum <= 0 {
+		set.quorum = 1
+	}
+	if set.quorum > len(set.sources) {
+		return nil, fmt.Errorf("quorum %d exceeds %d sources", set.quorum, len(set.sources))
+	}
+	return set, nil
+}
+
+// aggregate fetches all sources, discards observations outside the outlier
+// band around the median and returns the median of the survivors.
+func (s *sourceSet) aggregate(ctx context.Context) (*aggregateReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		report = &aggregateReport{Errors: make(map[string]error), Latency: make(map[string]time.Duration)}
+		obs    []*Observation
+	)
+	for _, source := range s.sources {
+		wg.Add(1)
+		go func(source PriceSource) {
+			defer wg.Done()
+			start := time.Now()
+			o, err := source.Fetch(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Latency[source.Name()] = time.Since(start)
+			if err != nil {
+				report.Errors[source.Name()] = err
+				return
+			}
+			obs = append(obs, o)
+		}(source)
+	}
+	wg.Wait()
+
+	if len(obs) < s.quorum {
+		return report, fmt.Errorf("%w: %d of %d sources answered, quorum %d", errNoQuorum, len(obs), len(s.sources), s.quorum)
+	}
+	mid := medianPrice(obs)
+	for _, o := range obs {
+		if s.outlierBps > 0 && !withinBand(o.Price, mid, s.outlierBps) {
+			report.Rejected = append(report.Rejected, o)
+			continue
+		}
+		report.Accepted = append(report.Accepted, o)
+	}
+	if len(report.Accepted) < s.quorum {
+		return report, fmt.Errorf("%w: %d of %d observations within %d bps of median, quorum %d", errNoQuorum, len(report.Accepted), len(obs), s.outlierBps, s.quorum)
+	}
+	report.Median = medianPrice(report.Accepted)
+	return report, nil
+}
+
+// medianPrice returns the median price of obs. For an even number of
+// observations it is the mean of the two middle prices.
+func medianPrice(obs []*Observation) *big.Rat {
+	prices := make([]*big.Rat, len(obs))
+	for i, o := range obs {
+		prices[i] = o.Price
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].Cmp(prices[j]) < 0 })
+
+	n := len(prices)
+	if n%2 == 1 {
+		return new(big.Rat).Set(prices[n/2])
+	}
+	sum := new(big.Rat).Add(prices[n/2-1], prices[n/2])
+	return sum.Quo(sum, big.NewRat(2, 1))
+}
+
+// withinBand reports whether price deviates from ref by at most bps basis points.
+func withinBand(price, ref *big.Rat, bps int64) bool {
+	diff := new(big.Rat).Sub(price, ref)
+	diff.Abs(diff)
+	diff.Mul(diff, big.NewRat(10000, 1))
+	limit := new(big.Rat).Mul(ref, big.NewRat(bps, 1))
+	return diff.Cmp(limit) <= 0
+}
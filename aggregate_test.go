@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// fixedSource answers with a constant price, or fails when price is empty.
+type fixedSource struct {
+	name  string
+	price string
+}
+
+func (s *fixedSource) Name() string { return s.name }
+
+func (s *fixedSource) Fetch(ctx context.Context) (*Observation, error) {
+	if s.price == "" {
+		return nil, errors.New("unavailable")
+	}
+	p, _ := new(big.Rat).SetString(s.price)
+	return &Observation{Source: s.name, Price: p, Timestamp: time.Now()}, nil
+}
+
+func rat(s string) *big.Rat {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		panic("bad rat " + s)
+	}
+	return r
+}
+
+func TestMedianPrice(t *testing.T) {
+	tests := []struct {
+		prices []string
+		median string
+	}{
+		{[]string{"5"}, "5"},
+		{[]string{"3", "1", "2"}, "2"},
+		{[]string{"4", "1", "3", "2"}, "5/2"},
+		{[]string{"1.5", "1.5", "100"}, "1.5"},
+	}
+	for _, tt := range tests {
+		var obs []*Observation
+		for _, p := range tt.prices {
+			obs = append(obs, &Observation{Price: rat(p)})
+		}
+		if got := medianPrice(obs); got.Cmp(rat(tt.median)) != 0 {
+			t.Errorf("median of %v = %v, want %v", tt.prices, got.RatString(), tt.median)
+		}
+	}
+}
+
+func TestWithinBand(t *testing.T) {
+	ref := rat("100")
+	tests := []struct {
+		price string
+		bps   int64
+		want  bool
+	}{
+		{"100", 0, true},
+		{"101", 100, true}, // exactly 100 bps above
+		{"99", 100, true},  // exactly 100 bps below
+		{"101.0001", 100, false},
+		{"98.9999", 100, false},
+		{"100.01", 0, false},
+	}
+	for _, tt := range tests {
+		if got := withinBand(rat(tt.price), ref, tt.bps); got != tt.want {
+			t.Errorf("withinBand(%s, 100, %d) = %v, want %v", tt.price, tt.bps, got, tt.want)
+		}
+	}
+}
+
+func TestAggregateQuorum(t *testing.T) {
+	tests := []struct {
+		name       string
+		prices     []string
+		quorum     int
+		outlierBps int64
+		median     string // empty when the quorum is missed
+		rejected   int
+	}{
+		{"all agree", []string{"100", "101", "102"}, 2, 500, "101", 0},
+		{"failed source within quorum", []string{"100", "", "102"}, 2, 500, "101", 0},
+		{"too many failed sources", []string{"100", "", ""}, 2, 500, "", 0},
+		{"outlier rejected", []string{"100", "101", "102", "150"}, 3, 500, "101", 1},
+		{"outliers break quorum", []string{"100", "150", "200"}, 2, 100, "", 2},
+		{"outlier filter disabled", []string{"100", "150", "200"}, 3, 0, "150", 0},
+	}
+	for _, tt := range tests {
+		set := &sourceSet{quorum: tt.quorum, outlierBps: tt.outlierBps, timeout: time.Second}
+		for i, p := range tt.prices {
+			set.sources = append(set.sources, &fixedSource{name: string(rune('a' + i)), price: p})
+		}
+		report, err := set.aggregate(context.Background())
+		if tt.median == "" {
+			if !errors.Is(err, errNoQuorum) {
+				t.Errorf("%s: err %v, want %v", tt.name, err, errNoQuorum)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if report.Median.Cmp(rat(tt.median)) != 0 {
+			t.Errorf("%s: median %v, want %v", tt.name, report.Median.RatString(), tt.median)
+		}
+		if len(report.Rejected) != tt.rejected {
+			t.Errorf("%s: %d rejected, want %d", tt.name, len(report.Rejected), tt.rejected)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+// Alert kinds raised by the daemon.
+const (
+	alertOutOfRange         = "answer_out_of_range"
+	alertTxReverted         = "tx_reverted"
+	alertSignerDisabled     = "signer_disabled"
+	alertFeedStale          = "feed_stale"
+	alertFailedTransmits    = "failed_transmits"
+	alertLowBalance         = "low_balance"
+	alertSourceDisagreement = "source_disagreement"
+	alertLowRunway          = "low_runway"
+)
+
+// alertDefaults are the thresholds of the kinds enabled when no rules are
+// configured. Zero low_balance and low_runway thresholds use the min_balance
+// and min_runway_days of the chain.
+var alertDefaults = map[string]float64{
+	alertOutOfRange:         0,
+	alertTxReverted:         0,
+	alertSignerDisabled:     0,
+	alertFeedStale:          0,
+	alertFailedTransmits:    3,
+	alertLowBalance:         0,
+	alertSourceDisagreement: 5,
+	alertLowRunway:          0,
+}
+
+const (
+	defaultRenotify    = time.Hour
+	staleCheckInterval = 30 * time.Second
+	webhookTimeout     = 10 * time.Second
+	webhookAttempts    = 3
+	webhookQueueSize   = 64
+)
+
+// Alert statuses.
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertSubjects are the context keys that tell apart alerts of the same kind
+// and feed.
+var alertSubjects = []string{"target", "chain", "signer"}
+
+// Alert is the notification delivered to webhooks, and the data of their
+// templates.
+type Alert struct {
+	Kind    string            `json:"kind"`
+	Status  string            `json:"status"`
+	Feed    string            `json:"feed,omitempty"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Count   int               `json:"count"` // times raised since it started firing
+	Since   time.Time         `json:"since"`
+	Time    time.Time         `json:"time"`
+}
+
+type alertRule struct {
+	kind      string
+	feed      string
+	threshold float64
+	renotify  time.Duration
+}
+
+type activeAlert struct {
+	alert    Alert
+	renotify time.Duration
+	notified time.Time
+}
+
+// alertManager de-duplicates alerts and hands them to the webhooks. An alert
+// is identified by kind, feed and subject; while it keeps firing it is only
+// sent again after the renotify interval of its rule, and once more when it
+// resolves.
+type alertManager struct {
+	rules []alertRule
+	hooks []*webhook
+
+	mu     sync.Mutex
+	active map[string]*activeAlert
+}
+
+// alerts is the alert manager of this node, nil until main set it up.
+var alerts *alertManager
+
+func newAlertManager(c config.Alerting) (*alertManager, error) {
+	renotify, err := config.ParseDuration(c.Renotify, defaultRenotify)
+	if err != nil {
+		return nil, fmt.Errorf("renotify: %v", err)
+	}
+	m := &alertManager{active: make(map[string]*activeAlert)}
+	for _, r := range c.Rules {
+		def, ok := alertDefaults[r.Kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown alert kind %q", r.Kind)
+		}
+		rule := alertRule{kind: r.Kind, feed: r.Feed, threshold: r.Threshold, renotify: renotify}
+		if rule.threshold == 0 {
+			rule.threshold = def
+		}
+		if rule.renotify, err = config.ParseDuration(r.Renotify, renotify); err != nil {
+			return nil, fmt.Errorf("rule %s: renotify: %v", r.Kind, err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	if len(c.Rules) == 0 {
+		for kind, threshold := range alertDefaults {
+			m.rules = append(m.rules, alertRule{kind: kind, threshold: threshold, renotify: renotify})
+		}
+	}
+	for _, w := range c.Webhooks {
+		hook, err := newWebhook(w)
+		if err != nil {
+			return nil, err
+		}
+		m.hooks = append(m.hooks, hook)
+		go hook.loop()
+	}
+	return m, nil
+}
+
+// rule returns the rule enabling kind for feed, preferring one naming the
+// feed, or nil if kind is disabled.
+func (m *alertManager) rule(kind, feed string) *alertRule {
+	var match *alertRule
+	for i, r := range m.rules {
+		if r.kind != kind {
+			continue
+		}
+		if r.feed == feed && feed != "" {
+			return &m.rules[i]
+		}
+		if r.feed == "" {
+			match = &m.rules[i]
+		}
+	}
+	return match
+}
+
+// alertThreshold returns the threshold of kind for feed and whether the kind
+// is enabled.
+func alertThreshold(kind, feed string) (float64, bool) {
+	if alerts == nil {
+		return alertDefaults[kind], true
+	}
+	r := alerts.rule(kind, feed)
+	if r == nil {
+		return 0, false
+	}
+	return r.threshold, true
+}
+
+func alertKey(kind, feed string, ctx []interface{}) string {
+	key := kind + "|" + feed
+	for i := 0; i+1 < len(ctx); i += 2 {
+		for _, subject := range alertSubjects {
+			if ctx[i] == subject {
+				key += fmt.Sprintf("|%s=%v", subject, ctx[i+1])
+			}
+		}
+	}
+	return key
+}
+
+func alertFields(ctx []interface{}) map[string]string {
+	fields := make(map[string]string, len(ctx)/2)
+	for i := 0; i+1 < len(ctx); i += 2 {
+		fields[fmt.Sprint(ctx[i])] = fmt.Sprint(ctx[i+1])
+	}
+	return fields
+}
+
+// raiseAlert reports a condition that needs operator attention. It is always
+// logged; the rules and renotify interval only decide whether it is sent to
+// the webhooks, which happens when it starts firing and again after every
+// renotify interval.
+func raiseAlert(kind, feed, msg string, ctx ...interface{}) {
+	logCtx := append([]interface{}{"kind", kind, "feed", feed}, ctx...)
+	if alerts != nil && !alerts.fire(kind, feed, msg, ctx) {
+		log.Warn("ALERT "+msg, logCtx...)
+		return
+	}
+	log.Error("ALERT "+msg, logCtx...)
+}
+
+// resolveAlert clears an alert raised with the same kind, feed and subject.
+func resolveAlert(kind, feed string, ctx ...interface{}) {
+	if alerts == nil {
+		return
+	}
+	key := alertKey(kind, feed, ctx)
+	alerts.mu.Lock()
+	a, ok := alerts.active[key]
+	delete(alerts.active, key)
+	alerts.mu.Unlock()
+	if !ok {
+		return
+	}
+	log.Info("Alert resolved", "kind", kind, "feed", feed, "since", a.alert.Since)
+	resolved := a.alert
+	resolved.Status, resolved.Time = alertResolved, time.Now()
+	alerts.notify(&resolved)
+}
+
+// fire records an occurrence of an alert and reports whether it was notified.
+func (m *alertManager) fire(kind, feed, msg string, ctx []interface{}) bool {
+	rule := m.rule(kind, feed)
+	if rule == nil {
+		return false
+	}
+	key := alertKey(kind, feed, ctx)
+	now := time.Now()
+
+	m.mu.Lock()
+	a, ok := m.active[key]
+	if !ok {
+		a = &activeAlert{alert: Alert{Kind: kind, Status: alertFiring, Feed: feed, Since: now}, renotify: rule.renotify}
+		m.active[key] = a
+	}
+	a.alert.Message, a.alert.Fields, a.alert.Time = msg, alertFields(ctx), now
+	a.alert.Count++
+	send := !ok || now.Sub(a.notified) >= a.renotify
+	if send {
+		a.notified = now
+	}
+	alert := a.alert
+	m.mu.Unlock()
+
+	if send {
+		m.notify(&alert)
+	}
+	return send
+}
+
+func (m *alertManager) notify(a *Alert) {
+	for _, hook := range m.hooks {
+		if len(hook.kinds) > 0 && !hook.kinds[a.Kind] {
+			continue
+		}
+		select {
+		case hook.queue <- a:
+		default:
+			log.Warn("Webhook queue full, dropping alert", "webhook", hook.name, "kind", a.Kind)
+		}
+	}
+}
+
+// webhook delivers alerts to one HTTP endpoint in order.
+type webhook struct {
+	name    string
+	url     string
+	headers map[string]string
+	tmpl    *template.Template // nil sends the alert as JSON
+	kinds   map[string]bool
+	queue   chan *Alert
+	client  *http.Client
+}
+
+func newWebhook(c config.Webhook) (*webhook, error) {
+	if c.Url == "" {
+		return nil, fmt.Errorf("webhook %q has no url", c.Name)
+	}
+	w := &webhook{
+		name:    c.Name,
+		url:     c.Url,
+		headers: c.Headers,
+		queue:   make(chan *Alert, webhookQueueSize),
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+	if w.name == "" {
+		w.name = c.Url
+	}
+	if c.Template != "" {
+		tmpl, err := template.New(w.name).Funcs(template.FuncMap{"json": templateJSON}).Parse(c.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: template: %v", w.name, err)
+		}
+		w.tmpl = tmpl
+	}
+	if len(c.Kinds) > 0 {
+		w.kinds = make(map[string]bool)
+		for _, kind := range c.Kinds {
+			if _, ok := alertDefaults[kind]; !ok {
+				return nil, fmt.Errorf("webhook %s: unknown alert kind %q", w.name, kind)
+			}
+			w.kinds[kind] = true
+		}
+	}
+	return w, nil
+}
+
+// templateJSON encodes v for use inside a JSON template, so
+// "{{json .Message}}" yields a quoted and escaped string.
+func templateJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (w *webhook) render(a *Alert) ([]byte, error) {
+	if w.tmpl == nil {
+		return json.Marshal(a)
+	}
+	var buf bytes.Buffer
+	if err := w.tmpl.Execute(&buf, a); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template output is not JSON: %s", strings.TrimSpace(buf.String()))
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *webhook) loop() {
+	for a := range w.queue {
+		if err := w.deliver(a); err != nil {
+			log.Warn("Failed to deliver alert", "webhook", w.name, "kind", a.Kind, "err", err)
+		}
+	}
+}
+
+// deliver posts a, retrying with backoff.
+func (w *webhook) deliver(a *Alert) error {
+	body, err := w.render(a)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		if err = w.post(body); err == nil || attempt+1 == webhookAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(1<<attempt) * time.Second)
+	}
+}
+
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// testAlerts sends a test alert to every webhook and reports the outcome.
+func (m *alertManager) testAlerts() error {
+	if len(m.hooks) == 0 {
+		return fmt.Errorf("no webhooks configured")
+	}
+	now := time.Now()
+	a := &Alert{Kind: "test", Status: alertFiring, Message: "Test alert", Count: 1, Since: now, Time: now}
+	var failed int
+	for _, hook := range m.hooks {
+		if err := hook.deliver(a); err != nil {
+			log.Error("Test alert failed", "webhook", hook.name, "err", err)
+			failed++
+			continue
+		}
+		log.Info("Test alert delivered", "webhook", hook.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d webhooks failed", failed, len(m.hooks))
+	}
+	return nil
+}
+
+// watchStaleness raises feed_stale for targets not updated within their
+// heartbeat plus grace.
+func watchStaleness(grace time.Duration) {
+	for {
+		time.Sleep(staleCheckInterval)
+		for name, f := range feeds {
+			for _, t := range f.targets {
+				if !t.state.known() {
+					continue
+				}
+				if err := f.checkStale(t, grace); err != nil {
+					raiseAlert(alertFeedStale, name, "Feed not updated on-chain", "target", t, "err", err)
+				} else {
+					resolveAlert(alertFeedStale, name, "target", t)
+				}
+			}
+		}
+	}
+}
+
+// checkDisagreement raises source_disagreement when the spread of the source
+// prices exceeds the threshold percentage of the median.
+func (f *feed) checkDisagreement(report *aggregateReport) {
+	threshold, ok := alertThreshold(alertSourceDisagreement, f.name)
+	if !ok || report.Median == nil || report.Median.Sign() == 0 {
+		return
+	}
+	obs := append(append([]*Observation{}, report.Accepted...), report.Rejected...)
+	if len(obs) < 2 {
+		return
+	}
+	lo, hi := obs[0].Price, obs[0].Price
+	for _, o := range obs[1:] {
+		if o.Price.Cmp(lo) < 0 {
+			lo = o.Price
+		}
+		if o.Price.Cmp(hi) > 0 {
+			hi = o.Price
+		}
+	}
+	spread := new(big.Rat).Sub(hi, lo)
+	spread.Quo(spread, new(big.Rat).Abs(report.Median))
+	percent := ratFloat(spread) * 100
+	if percent > threshold {
+		raiseAlert(alertSourceDisagreement, f.name, "Price sources disagree",
+			"spread_percent", fmt.Sprintf("%.2f", percent), "low", lo.FloatString(8), "high", hi.FloatString(8), "threshold", threshold)
+		return
+	}
+	resolveAlert(alertSourceDisagreement, f.name)
+}
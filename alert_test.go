@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+)
+
+// webhookStandIn records the bodies POSTed to a local webhook.
+func webhookStandIn(t *testing.T) (*httptest.Server, <-chan []byte) {
+	t.Helper()
+	bodies := make(chan []byte, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		bodies <- body
+	}))
+	t.Cleanup(srv.Close)
+	return srv, bodies
+}
+
+// useAlerts installs an alert manager for c for the duration of the test.
+func useAlerts(t *testing.T, c config.Alerting) {
+	t.Helper()
+	m, err := newAlertManager(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := alerts
+	alerts = m
+	t.Cleanup(func() { alerts = prev })
+}
+
+func receiveAlert(t *testing.T, bodies <-chan []byte) *Alert {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		var a Alert
+		if err := json.Unmarshal(body, &a); err != nil {
+			t.Fatalf("alert body %s: %v", body, err)
+		}
+		return &a
+	case <-time.After(2 * time.Second):
+		t.Fatal("no alert delivered")
+	}
+	return nil
+}
+
+func expectNoAlert(t *testing.T, bodies <-chan []byte) {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		t.Fatalf("unexpected alert %s", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestAlertDeliveryAndDeduplication(t *testing.T) {
+	srv, bodies := webhookStandIn(t)
+	useAlerts(t, config.Alerting{
+		Renotify: "1h",
+		Webhooks: []config.Webhook{{Name: "ops", Url: srv.URL, Headers: map[string]string{"X-Token": "secret"}}},
+	})
+
+	raiseAlert(alertTxReverted, testFeed, "Transmission reverted", "target", "czz:0x01", "round", 7)
+	a := receiveAlert(t, bodies)
+	if a.Kind != alertTxReverted || a.Status != alertFiring || a.Feed != testFeed || a.Count != 1 {
+		t.Fatalf("delivered %+v", a)
+	}
+	if a.Fields["target"] != "czz:0x01" || a.Fields["round"] != "7" {
+		t.Fatalf("fields %v", a.Fields)
+	}
+
+	// Repeats within the renotify interval are not delivered again; another
+	// subject is a separate alert.
+	raiseAlert(alertTxReverted, testFeed, "Transmission reverted", "target", "czz:0x01", "round", 8)
+	expectNoAlert(t, bodies)
+	raiseAlert(alertTxReverted, testFeed, "Transmission reverted", "target", "czz:0x02", "round", 8)
+	if a := receiveAlert(t, bodies); a.Fields["target"] != "czz:0x02" || a.Count != 1 {
+		t.Fatalf("delivered %+v", a)
+	}
+
+	resolveAlert(alertTxReverted, testFeed, "target", "czz:0x01")
+	a = receiveAlert(t, bodies)
+	if a.Status != alertResolved || a.Fields["target"] != "czz:0x01" || a.Count != 2 {
+		t.Fatalf("resolved %+v", a)
+	}
+	resolveAlert(alertTxReverted, testFeed, "target", "czz:0x01")
+	expectNoAlert(t, bodies)
+
+	// Once resolved, the alert fires again from scratch.
+	raiseAlert(alertTxReverted, testFeed, "Transmission reverted", "target", "czz:0x01", "round", 9)
+	if a := receiveAlert(t, bodies); a.Status != alertFiring || a.Count != 1 {
+		t.Fatalf("delivered %+v", a)
+	}
+}
+
+func TestAlertRenotify(t *testing.T) {
+	srv, bodies := webhookStandIn(t)
+	useAlerts(t, config.Alerting{
+		Webhooks: []config.Webhook{{Url: srv.URL, Headers: map[string]string{"X-Token": "secret"}}},
+		Rules:    []config.AlertRule{{Kind: alertFeedStale, Renotify: "300ms"}},
+	})
+
+	raiseAlert(alertFeedStale, testFeed, "Feed not updated on-chain", "target", "czz:0x01")
+	receiveAlert(t, bodies)
+	raiseAlert(alertFeedStale, testFeed, "Feed not updated on-chain", "target", "czz:0x01")
+	expectNoAlert(t, bodies)
+	time.Sleep(300 * time.Millisecond)
+	raiseAlert(alertFeedStale, testFeed, "Feed not updated on-chain", "target", "czz:0x01")
+	if a := receiveAlert(t, bodies); a.Count != 3 {
+		t.Fatalf("renotified %+v, want count 3", a)
+	}
+
+	// Kinds without a rule are only logged.
+	raiseAlert(alertTxReverted, testFeed, "Transmission reverted", "target", "czz:0x01")
+	expectNoAlert(t, bodies)
+}
+
+func TestAlertTemplate(t *testing.T) {
+	srv, bodies := webhookStandIn(t)
+	useAlerts(t, config.Alerting{
+		Webhooks: []config.Webhook{{
+			Url:      srv.URL,
+			Headers:  map[string]string{"X-Token": "secret"},
+			Kinds:    []string{alertLowBalance},
+			Template: `{"text": {{json (printf "[%s] %s %s" .Status .Feed .Message)}}, "chain": {{json (index .Fields "chain")}}}`,
+		}},
+	})
+
+	// Kinds the webhook does not subscribe to are not delivered to it.
+	raiseAlert(alertTxReverted, testFeed, "Transmission reverted", "target", "czz:0x01")
+	expectNoAlert(t, bodies)
+
+	raiseAlert(alertLowBalance, "", `Signer balance "low"`, "chain", "czz", "signer", "0x01")
+	var got struct {
+		Text  string `json:"text"`
+		Chain string `json:"chain"`
+	}
+	select {
+	case body := <-bodies:
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("template body %s: %v", body, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no alert delivered")
+	}
+	if want := `[firing]  Signer balance "low"`; got.Text != want || got.Chain != "czz" {
+		t.Fatalf("rendered %+v, want text %q and chain czz", got, want)
+	}
+}
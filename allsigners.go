@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/czzclient"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+// roundBatch collects the outcome of every signer transmitting the same
+// round in all-signers mode. The aggregator only accepts the first
+// transmission of a round (later ones revert with a stale round id, or
+// "Admin repeated submission" for a signer that already answered), so
+// losing that race is an expected outcome rather than a failure.
+type roundBatch struct {
+	feed  string
+	t     *aggregatorTarget
+	round uint32
+
+	mu      sync.Mutex
+	pending int
+	landed  []common.Address
+	lost    []common.Address
+	failed  []common.Address
+}
+
+// lostRace reports whether err means another transmission filled the round.
+func lostRace(err error) bool {
+	return errors.Is(err, errStaleRound) || errors.Is(err, errRepeatedSubmission)
+}
+
+// record stores the outcome of one signer and logs a summary once every
+// signer of the batch has settled.
+func (b *roundBatch) record(signer common.Address, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case err == nil:
+		b.landed = append(b.landed, signer)
+	case lostRace(err):
+		b.lost = append(b.lost, signer)
+	default:
+		b.failed = append(b.failed, signer)
+	}
+	b.pending--
+	if b.pending > 0 {
+		return
+	}
+	if len(b.landed) == 0 && len(b.failed) > 0 {
+		log.Warn("All-signer round not filled by us", "feed", b.feed, "target", b.t, "round", b.round, "lost", b.lost, "failed", b.failed)
+		return
+	}
+	log.Info("All-signer round settled", "feed", b.feed, "target", b.t, "round", b.round, "landed", b.landed, "lost", b.lost, "failed", b.failed)
+}
+
+// transmitAll lets every signer transmit answer for the same round
+// concurrently, one nonce stream per signer.
+func (f *feed) transmitAll(t *aggregatorTarget, signers []*signer, instance *Aggregator, client *czzclient.Client, round uint32, answer *big.Int) {
+	batch := &roundBatch{feed: f.name, t: t, round: round, pending: len(signers)}
+	var wg sync.WaitGroup
+	for _, s := range signers {
+		wg.Add(1)
+		go func(s *signer) {
+			defer wg.Done()
+			f.transmit(t, s, instance, client, round, answer, batch, nil)
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+	apiRPCTimeout   = 10 * time.Second
+)
+
+// feeds are the running feeds served by the API.
+var feeds = make(map[string]*feed)
+
+// feedStatus is the state of one feed as served by the API.
+type feedStatus struct {
+	Name         string              `json:"name"`
+	Sources      []*sourceStatus     `json:"sources"`
+	Median       string              `json:"median,omitempty"`
+	AggregatedAt *time.Time          `json:"aggregated_at,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	Targets      []*targetFeedStatus `json:"targets"`
+}
+
+// targetFeedStatus is a target with its latest on-chain round.
+type targetFeedStatus struct {
+	targetStatus
+	Onchain *onchainRound `json:"onchain,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type onchainRound struct {
+	Round     uint32    `json:"round"`
+	Answer    *big.Int  `json:"answer"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (f *feed) status(ctx context.Context) *feedStatus {
+	f.mu.Lock()
+	s := &feedStatus{Name: f.name, Sources: make([]*sourceStatus, 0, len(f.observations))}
+	for _, o := range f.observations {
+		s.Sources = append(s.Sources, o)
+	}
+	if f.median != nil {
+		s.Median = f.median.FloatString(8)
+	}
+	if !f.aggregatedAt.IsZero() {
+		at := f.aggregatedAt
+		s.AggregatedAt = &at
+	}
+	if f.aggErr != nil {
+		s.Error = f.aggErr.Error()
+	}
+	f.mu.Unlock()
+	sort.Slice(s.Sources, func(i, j int) bool { return s.Sources[i].Source < s.Sources[j].Source })
+
+	for _, t := range f.targets {
+		ts := &targetFeedStatus{targetStatus: t.status()}
+		if latest, err := f.onchain(ctx, t); err != nil {
+			ts.Error = err.Error()
+		} else {
+			ts.Onchain = &onchainRound{Round: latest.Round, Answer: latest.Answer, UpdatedAt: latest.UpdatedAt}
+		}
+		s.Targets = append(s.Targets, ts)
+	}
+	return s
+}
+
+func (f *feed) onchain(ctx context.Context, t *aggregatorTarget) (roundData, error) {
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		return roundData{}, err
+	}
+	return t.latestRound(ctx, client)
+}
+
+// newAPIHandler returns the read-only HTTP API:
+//
+//	GET /api/feeds                 state of every feed
+//	GET /api/feed?name=CZZ/USDT    state of one feed
+//	GET /api/history?feed=CZZ/USDT&kind=transmissions&from=&to=&offset=&limit=
+//	GET /api/signers               balance, spend and runway of every signer
+//
+// History kinds are observations, aggregates, decisions and transmissions;
+// from and to are RFC 3339 times or unix seconds.
+func newAPIHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/feeds", serveFeeds)
+	mux.HandleFunc("/api/feed", serveFeed)
+	mux.HandleFunc("/api/history", serveHistory)
+	mux.HandleFunc("/api/signers", serveSigners)
+	return mux
+}
+
+// serveAPI serves handler on addr.
+func serveAPI(addr string, handler http.Handler) {
+	log.Info("HTTP API listening", "addr", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Error("HTTP API stopped", "err", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func serveFeeds(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), apiRPCTimeout)
+	defer cancel()
+	names := make([]string, 0, len(feeds))
+	for name := range feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]*feedStatus, len(names))
+	for i, name := range names {
+		res[i] = feeds[name].status(ctx)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func serveFeed(w http.ResponseWriter, r *http.Request) {
+	f, ok := feeds[r.URL.Query().Get("name")]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown feed %q", r.URL.Query().Get("name")))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), apiRPCTimeout)
+	defer cancel()
+	writeJSON(w, http.StatusOK, f.status(ctx))
+}
+
+func serveSigners(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, balances.snapshot())
+}
+
+// historyPage is one page of history records.
+type historyPage struct {
+	Feed       string      `json:"feed"`
+	Kind       string      `json:"kind"`
+	Offset     int         `json:"offset"`
+	Limit      int         `json:"limit"`
+	NextOffset *int        `json:"next_offset,omitempty"`
+	Records    interface{} `json:"records"`
+}
+
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	if history == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("history is disabled"))
+		return
+	}
+	q, err := parseHistoryQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := feeds[q.Feed]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown feed %q", q.Feed))
+		return
+	}
+	var (
+		records interface{}
+		n       int
+	)
+	kind := r.URL.Query().Get("kind")
+	switch kind {
+	case "observations":
+		res, e := history.Observations(q)
+		records, n, err = res, len(res), e
+	case "aggregates":
+		res, e := history.Aggregates(q)
+		records, n, err = res, len(res), e
+	case "decisions":
+		res, e := history.Decisions(q)
+		records, n, err = res, len(res), e
+	case "", "transmissions":
+		kind = "transmissions"
+		res, e := history.Transmissions(q)
+		records, n, err = res, len(res), e
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown kind %q", kind))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	page := &historyPage{Feed: q.Feed, Kind: kind, Offset: q.Offset, Limit: q.Limit, Records: records}
+	if n == q.Limit {
+		next := q.Offset + n
+		page.NextOffset = &next
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func parseHistoryQuery(r *http.Request) (historyQuery, error) {
+	v := r.URL.Query()
+	q := historyQuery{Feed: v.Get("feed"), Limit: defaultPageSize}
+	var err error
+	if q.From, err = parseTime(v.Get("from")); err != nil {
+		return q, fmt.Errorf("from: %v", err)
+	}
+	if q.To, err = parseTime(v.Get("to")); err != nil {
+		return q, fmt.Errorf("to: %v", err)
+	}
+	if s := v.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("invalid offset %q", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	if q.Limit > maxPageSize {
+		q.Limit = maxPageSize
+	}
+	return q, nil
+}
+
+// parseTime accepts an RFC 3339 time or unix seconds.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
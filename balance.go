@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/core/types"
+	"github.com/classzz/go-classzz-v2/log"
+	"github.com/classzz/go-classzz-v2/metrics"
+	"github.com/classzz/go-classzz-v2/params"
+)
+
+const (
+	balancePollInterval = time.Minute
+	spendWindow         = 24 * time.Hour // gas spend considered for the runway
+	minSpendPeriod      = time.Hour      // shortest period a spend rate is extrapolated from
+)
+
+type balanceKey struct {
+	chain   string
+	address common.Address
+}
+
+type spend struct {
+	at  time.Time
+	wei *big.Int
+}
+
+// signerAccount is the polled balance of a signer on one chain and the gas
+// it spent recently.
+type signerAccount struct {
+	balance  *big.Int
+	polledAt time.Time
+	since    time.Time // start of the spend record
+	spends   []spend
+}
+
+// spendPerDay extrapolates the spend of the last spendWindow to one day.
+func (a *signerAccount) spendPerDay(now time.Time) *big.Rat {
+	from := now.Add(-spendWindow)
+	if a.since.After(from) {
+		from = a.since
+	}
+	period := now.Sub(from)
+	if period < minSpendPeriod {
+		period = minSpendPeriod
+	}
+	total := new(big.Int)
+	for _, s := range a.spends {
+		if s.at.After(from) {
+			total.Add(total, s.wei)
+		}
+	}
+	perDay := new(big.Rat).SetInt(total)
+	return perDay.Mul(perDay, new(big.Rat).SetFrac64(int64(24*time.Hour), int64(period)))
+}
+
+// minedFee returns the fee paid by the transaction of receipt, which may be a
+// bumped replacement of the one first sent. Receipts carry no effective gas
+// price, so a dynamic fee transaction pays min(fee cap, base fee + tip) of
+// its block.
+func minedFee(ctx context.Context, chain *evmChain, receipt *types.Receipt) (*big.Int, error) {
+	client, err := chain.pool.Client()
+	if err != nil {
+		return nil, err
+	}
+	tx, _, err := client.TransactionByHash(ctx, receipt.TxHash)
+	if err != nil {
+		return nil, err
+	}
+	price := tx.GasPrice()
+	if tx.Type() == types.DynamicFeeTxType {
+		header, err := client.HeaderByNumber(ctx, receipt.BlockNumber)
+		if err != nil {
+			return nil, err
+		}
+		if header.BaseFee != nil {
+			price = new(big.Int).Add(header.BaseFee, tx.GasTipCap())
+			if price.Cmp(tx.GasFeeCap()) > 0 {
+				price = tx.GasFeeCap()
+			}
+		}
+	}
+	return new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), price), nil
+}
+
+// balanceBook holds the last polled balance and recent gas spend of every
+// signer per chain, and the cost bound of the last transmission per chain.
+type balanceBook struct {
+	mu       sync.RWMutex
+	accounts map[balanceKey]*signerAccount
+	txCost   map[string]*big.Int
+}
+
+var balances = &balanceBook{
+	accounts: make(map[balanceKey]*signerAccount),
+	txCost:   make(map[string]*big.Int),
+}
+
+func (b *balanceBook) account(chain string, addr common.Address) *signerAccount {
+	key := balanceKey{chain, addr}
+	acc, ok := b.accounts[key]
+	if !ok {
+		acc = &signerAccount{since: time.Now()}
+		b.accounts[key] = acc
+	}
+	return acc
+}
+
+func (b *balanceBook) set(chain string, addr common.Address, balance *big.Int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	acc := b.account(chain, addr)
+	acc.balance, acc.polledAt = balance, time.Now()
+}
+
+// get returns the last polled balance of addr on chain, nil if unknown.
+func (b *balanceBook) get(chain string, addr common.Address) *big.Int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if acc, ok := b.accounts[balanceKey{chain, addr}]; ok {
+		return acc.balance
+	}
+	return nil
+}
+
+// recordSpend adds the fee of a mined transaction of addr on chain.
+func (b *balanceBook) recordSpend(chain string, addr common.Address, wei *big.Int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	acc := b.account(chain, addr)
+	now := time.Now()
+	cutoff := now.Add(-spendWindow)
+	for len(acc.spends) > 0 && acc.spends[0].at.Before(cutoff) {
+		acc.spends = acc.spends[1:]
+	}
+	acc.spends = append(acc.spends, spend{at: now, wei: wei})
+}
+
+// setTxCost remembers the maximum cost of the last transmission on chain.
+func (b *balanceBook) setTxCost(chain string, cost *big.Int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.txCost[chain] = cost
+}
+
+// affordable returns the candidates able to pay for a transmission as
+// expensive as the last one on chain. Signers without a polled balance are
+// kept, as are all while no transmission cost is known.
+func (b *balanceBook) affordable(chain string, candidates []*signer) []*signer {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	cost := b.txCost[chain]
+	if cost == nil {
+		return candidates
+	}
+	var res []*signer
+	for _, s := range candidates {
+		acc, ok := b.accounts[balanceKey{chain, s.address}]
+		if ok && acc.balance != nil && acc.balance.Cmp(cost) < 0 {
+			log.Warn("Signer cannot afford transmission", "chain", chain, "signer", s.address, "balance", weiToEther(acc.balance), "cost", weiToEther(cost))
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// signerRunway is the balance outlook of a signer on one chain.
+type signerRunway struct {
+	Chain       string         `json:"chain"`
+	Address     common.Address `json:"address"`
+	Balance     float64        `json:"balance"`
+	SpendPerDay float64        `json:"spend_per_day"`
+	RunwayDays  *float64       `json:"runway_days,omitempty"` // unset while nothing was spent
+	PolledAt    time.Time      `json:"polled_at"`
+}
+
+func (b *balanceBook) runway(chain string, addr common.Address) (signerRunway, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	acc, ok := b.accounts[balanceKey{chain, addr}]
+	if !ok || acc.balance == nil {
+		return signerRunway{}, false
+	}
+	return acc.runway(chain, addr), true
+}
+
+func (a *signerAccount) runway(chain string, addr common.Address) signerRunway {
+	perDay := a.spendPerDay(time.Now())
+	r := signerRunway{
+		Chain:       chain,
+		Address:     addr,
+		Balance:     weiToEther(a.balance),
+		SpendPerDay: ratFloat(new(big.Rat).Quo(perDay, new(big.Rat).SetInt(big.NewInt(params.Ether)))),
+		PolledAt:    a.polledAt,
+	}
+	if perDay.Sign() > 0 {
+		days := ratFloat(new(big.Rat).Quo(new(big.Rat).SetInt(a.balance), perDay))
+		r.RunwayDays = &days
+	}
+	return r
+}
+
+// snapshot returns the outlook of every polled signer.
+func (b *balanceBook) snapshot() []signerRunway {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var res []signerRunway
+	for key, acc := range b.accounts {
+		if acc.balance != nil {
+			res = append(res, acc.runway(key.chain, key.address))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Chain != res[j].Chain {
+			return res[i].Chain < res[j].Chain
+		}
+		return res[i].Address.Hex() < res[j].Address.Hex()
+	})
+	return res
+}
+
+// checkBalance raises low_balance when balance is below the rule threshold,
+// or the min_balance of chain if the rule has none.
+func checkBalance(chain *evmChain, addr common.Address, balance *big.Int) {
+	threshold, ok := alertThreshold(alertLowBalance, "")
+	if !ok {
+		return
+	}
+	limit := chain.minBalance
+	if threshold > 0 {
+		limit, _ = new(big.Float).Mul(big.NewFloat(threshold), big.NewFloat(params.Ether)).Int(nil)
+	}
+	if limit == nil {
+		return
+	}
+	if balance.Cmp(limit) < 0 {
+		raiseAlert(alertLowBalance, "", "Signer balance low", "chain", chain.name, "signer", addr, "balance", weiToEther(balance), "threshold", weiToEther(limit))
+		return
+	}
+	resolveAlert(alertLowBalance, "", "chain", chain.name, "signer", addr)
+}
+
+// checkRunway warns and raises low_runway when the balance of addr lasts less
+// than the min_runway_days of chain at the recent spend rate.
+func checkRunway(chain *evmChain, addr common.Address) {
+	r, ok := balances.runway(chain.name, addr)
+	if !ok {
+		return
+	}
+	name := metricName("signer", chain.name, addr.Hex())
+	metrics.GetOrRegisterGaugeFloat64(name+"/spend_per_day", nil).Update(r.SpendPerDay)
+	days := math.Inf(1)
+	if r.RunwayDays != nil {
+		days = *r.RunwayDays
+		metrics.GetOrRegisterGaugeFloat64(name+"/runway_days", nil).Update(days)
+	}
+	// The warning is logged whatever the rules; a low_runway rule only adds
+	// webhook delivery and may override the threshold.
+	threshold := chain.minRunwayDays
+	if t, ok := alertThreshold(alertLowRunway, ""); ok && t > 0 {
+		threshold = t
+	}
+	if threshold == 0 {
+		return
+	}
+	if days < threshold {
+		raiseAlert(alertLowRunway, "", "Signer balance runs out soon", "chain", chain.name, "signer", addr,
+			"runway_days", fmt.Sprintf("%.1f", days), "balance", r.Balance, "spend_per_day", r.SpendPerDay)
+		return
+	}
+	resolveAlert(alertLowRunway, "", "chain", chain.name, "signer", addr)
+}
+
+// watchBalances polls the balance of every signer on every chain.
+func watchBalances(chains map[string]*evmChain, signers []*signer) {
+	for {
+		for _, chain := range chains {
+			client, err := chain.pool.Client()
+			if err != nil {
+				continue
+			}
+			for _, s := range signers {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				balance, err := client.BalanceAt(ctx, s.address, nil)
+				cancel()
+				if err != nil {
+					log.Debug("Failed to read signer balance", "chain", chain.name, "signer", s.address, "err", err)
+					chain.pool.reportFailure(client, err)
+					continue
+				}
+				balances.set(chain.name, s.address, balance)
+				metrics.GetOrRegisterGaugeFloat64(metricName("signer", chain.name, s.address.Hex(), "balance"), nil).Update(weiToEther(balance))
+				checkBalance(chain, s.address, balance)
+				checkRunway(chain, s.address)
+			}
+		}
+		time.Sleep(balancePollInterval)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+	"github.com/classzz/go-classzz-v2/czzclient"
+	"github.com/classzz/go-classzz-v2/params"
+)
+
+const defaultBaseFeePercent = 200
+
+// evmChain is a configured network with its shared RPC client pool.
+type evmChain struct {
+	name string
+	id   *big.Int
+	pool *clientPool
+	gas  config.GasPolicy
+
+	maxFee *big.Int // nil when unbounded
+	maxTip *big.Int // nil when unbounded
+
+	minBalance    *big.Int // nil when unchecked
+	minRunwayDays float64
+
+	txTimeout   time.Duration
+	bumpPercent int
+	maxBumps    int
+}
+
+func newEvmChain(c config.Chain) (*evmChain, error) {
+	if c.Gas.PricePercent < 0 || c.Gas.BaseFeePercent < 0 {
+		return nil, fmt.Errorf("chain %q: negative gas percent", c.Name)
+	}
+	if c.Gas.MaxFeeGwei < 0 || c.Gas.MaxTipGwei < 0 {
+		return nil, fmt.Errorf("chain %q: negative gas cap", c.Name)
+	}
+	txTimeout, err := config.ParseDuration(c.Gas.TxTimeout, defaultTxTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("chain %q: tx_timeout: %v", c.Name, err)
+	}
+	if c.Gas.BumpPercent != 0 && c.Gas.BumpPercent < minBumpPercent {
+		return nil, fmt.Errorf("chain %q: bump_percent below the replacement minimum of %d", c.Name, minBumpPercent)
+	}
+	if c.Gas.MaxBumps < 0 {
+		return nil, fmt.Errorf("chain %q: negative max_bumps", c.Name)
+	}
+	pool, err := newClientPool(c)
+	if err != nil {
+		return nil, err
+	}
+	id := c.ChainId
+	if id == 0 {
+		if id, err = pool.ChainID(); err != nil {
+			return nil, err
+		}
+	}
+	chain := &evmChain{
+		name: c.Name,
+		id:   new(big.Int).SetUint64(id),
+		pool: pool,
+		gas:  c.Gas,
+
+		txTimeout:   txTimeout,
+		bumpPercent: c.Gas.BumpPercent,
+		maxBumps:    c.Gas.MaxBumps,
+	}
+	if chain.bumpPercent == 0 {
+		chain.bumpPercent = defaultBumpPercent
+	}
+	if chain.maxBumps == 0 {
+		chain.maxBumps = defaultMaxBumps
+	}
+	if c.MinBalance < 0 {
+		return nil, fmt.Errorf("chain %q: negative min_balance", c.Name)
+	}
+	if c.MinRunwayDays < 0 {
+		return nil, fmt.Errorf("chain %q: negative min_runway_days", c.Name)
+	}
+	chain.minRunwayDays = c.MinRunwayDays
+	if c.MinBalance > 0 {
+		chain.minBalance, _ = new(big.Float).Mul(big.NewFloat(c.MinBalance), big.NewFloat(params.Ether)).Int(nil)
+	}
+	if c.Gas.MaxFeeGwei > 0 {
+		chain.maxFee = gweiToWei(c.Gas.MaxFeeGwei)
+	}
+	if c.Gas.MaxTipGwei > 0 {
+		chain.maxTip = gweiToWei(c.Gas.MaxTipGwei)
+	}
+	if c.Gas.BaseFeePercent == 0 {
+		chain.gas.BaseFeePercent = defaultBaseFeePercent
+	}
+	return chain, nil
+}
+
+// txFees is the pricing of one transaction. GasPrice is set for legacy
+// transactions, FeeCap and TipCap for dynamic fee transactions.
+type txFees struct {
+	GasPrice *big.Int
+	FeeCap   *big.Int
+	TipCap   *big.Int
+}
+
+func (f *txFees) dynamic() bool { return f.GasPrice == nil }
+
+// suggestFees prices a transaction from the node's suggestions, building
+// dynamic fees on London-enabled chains and capping both at the configured
+// limits.
+func (c *evmChain) suggestFees(ctx context.Context, client *czzclient.Client) (*txFees, error) {
+	var baseFee *big.Int
+	if !c.gas.Legacy {
+		head, err := client.HeaderByNumber(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		baseFee = head.BaseFee
+	}
+	if baseFee == nil {
+		price, err := client.SuggestGasPrice(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if c.gas.PricePercent != 0 {
+			price = percentOf(price, c.gas.PricePercent)
+		}
+		return &txFees{GasPrice: capAt(price, c.maxFee)}, nil
+	}
+	tip, err := client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tip = capAt(tip, c.maxTip)
+	feeCap := new(big.Int).Add(percentOf(baseFee, c.gas.BaseFeePercent), tip)
+	feeCap = capAt(feeCap, c.maxFee)
+	if tip.Cmp(feeCap) > 0 {
+		tip = new(big.Int).Set(feeCap)
+	}
+	return &txFees{FeeCap: feeCap, TipCap: tip}, nil
+}
+
+// capAt returns v limited to max, or v if max is nil.
+func capAt(v, max *big.Int) *big.Int {
+	if max != nil && v.Cmp(max) > 0 {
+		return new(big.Int).Set(max)
+	}
+	return v
+}
+
+func percentOf(v *big.Int, percent int) *big.Int {
+	r := new(big.Int).Mul(v, big.NewInt(int64(percent)))
+	return r.Div(r, big.NewInt(100))
+}
+
+func gweiToWei(gwei float64) *big.Int {
+	wei, _ := new(big.Float).Mul(big.NewFloat(gwei), big.NewFloat(params.GWei)).Int(nil)
+	return wei
+}
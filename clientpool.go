@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+	"github.com/classzz/go-classzz-v2/czzclient"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultMaxBlockAge    = 5 * time.Minute
+	defaultMaxBlockLag    = 5
+	healthCheckTimeout    = 10 * time.Second
+)
+
+var errNoHealthyEndpoint = errors.New("no healthy rpc endpoint")
+
+// rpcEndpoint is one RPC url of a chain and the result of its last health
+// check.
+type rpcEndpoint struct {
+	url       string
+	client    *czzclient.Client
+	chainID   uint64 // reported by the node, 0 until first fetched
+	healthy   bool
+	height    uint64
+	headTime  time.Time
+	latency   time.Duration
+	err       error
+	checkedAt time.Time
+}
+
+// clientPool keeps long-lived clients to every RPC endpoint of a chain and
+// hands out the preferred healthy one. Endpoints are preferred in config
+// order; the pool fails over to the next healthy endpoint when the current
+// one falls behind, stops answering or is reported failing.
+type clientPool struct {
+	chain       string
+	chainID     uint64 // expected chain id, 0 accepts any
+	interval    time.Duration
+	maxBlockAge time.Duration
+	maxBlockLag uint64
+	maxLatency  time.Duration // 0 disables
+
+	mu        sync.RWMutex
+	endpoints []*rpcEndpoint
+	current   int // index of the endpoint in use, -1 if none is healthy
+}
+
+func newClientPool(chain config.Chain) (*clientPool, error) {
+	if len(chain.RpcUrls) == 0 {
+		return nil, fmt.Errorf("chain %q has no rpc_urls", chain.Name)
+	}
+	interval, err := config.ParseDuration(chain.HealthInterval, defaultHealthInterval)
+	if err != nil {
+		return nil, fmt.Errorf("chain %q: health_interval: %v", chain.Name, err)
+	}
+	maxBlockAge, err := config.ParseDuration(chain.MaxBlockAge, defaultMaxBlockAge)
+	if err != nil {
+		return nil, fmt.Errorf("chain %q: max_block_age: %v", chain.Name, err)
+	}
+	maxLatency, err := config.ParseDuration(chain.MaxLatency, 0)
+	if err != nil {
+		return nil, fmt.Errorf("chain %q: max_latency: %v", chain.Name, err)
+	}
+	p := &clientPool{
+		chain:       chain.Name,
+		chainID:     chain.ChainId,
+		interval:    interval,
+		maxBlockAge: maxBlockAge,
+		maxBlockLag: chain.MaxBlockLag,
+		maxLatency:  maxLatency,
+		current:     -1,
+	}
+	if p.maxBlockLag == 0 {
+		p.maxBlockLag = defaultMaxBlockLag
+	}
+	for _, url := range chain.RpcUrls {
+		client, err := czzclient.Dial(url)
+		if err != nil {
+			return nil, fmt.Errorf("chain %q: dial %s: %v", chain.Name, url, err)
+		}
+		p.endpoints = append(p.endpoints, &rpcEndpoint{url: url, client: client})
+	}
+	p.check()
+	go p.loop()
+	return p, nil
+}
+
+// ChainID returns the chain id reported by the endpoint in use.
+func (p *clientPool) ChainID() (uint64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.current < 0 {
+		return 0, fmt.Errorf("chain %s: %w", p.chain, errNoHealthyEndpoint)
+	}
+	return p.endpoints[p.current].chainID, nil
+}
+
+// Client returns the client of the endpoint currently in use.
+func (p *clientPool) Client() (*czzclient.Client, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.current < 0 {
+		return nil, fmt.Errorf("chain %s: %w", p.chain, errNoHealthyEndpoint)
+	}
+	return p.endpoints[p.current].client, nil
+}
+
+// reportFailure marks the endpoint of client unhealthy after a failed call
+// and fails over to the next healthy endpoint. The next health check may
+// bring it back.
+func (p *clientPool) reportFailure(client *czzclient.Client, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, ep := range p.endpoints {
+		if ep.client != client || !ep.healthy {
+			continue
+		}
+		ep.healthy, ep.err = false, err
+		log.Warn("RPC endpoint failed", "chain", p.chain, "url", ep.url, "err", err)
+		if i == p.current {
+			p.selectLocked()
+		}
+	}
+}
+
+func (p *clientPool) loop() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.check()
+	}
+}
+
+// check probes every endpoint concurrently and reselects the endpoint in use.
+func (p *clientPool) check() {
+	type result struct {
+		chainID  uint64
+		height   uint64
+		headTime time.Time
+		latency  time.Duration
+		err      error
+	}
+	results := make([]result, len(p.endpoints))
+
+	var wg sync.WaitGroup
+	for i, ep := range p.endpoints {
+		wg.Add(1)
+		go func(i int, client *czzclient.Client, chainID uint64) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			defer cancel()
+			if chainID == 0 {
+				id, err := client.ChainID(ctx)
+				if err != nil {
+					results[i].err = err
+					return
+				}
+				chainID = id.Uint64()
+			}
+			start := time.Now()
+			head, err := client.HeaderByNumber(ctx, nil)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			results[i] = result{
+				chainID:  chainID,
+				height:   head.Number.Uint64(),
+				headTime: time.Unix(int64(head.Time), 0),
+				latency:  time.Since(start),
+			}
+		}(i, ep.client, ep.chainID)
+	}
+	wg.Wait()
+
+	var best uint64
+	for _, r := range results {
+		if r.err == nil && r.height > best {
+			best = r.height
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for i, ep := range p.endpoints {
+		r := results[i]
+		ep.height, ep.headTime, ep.latency, ep.err, ep.checkedAt = r.height, r.headTime, r.latency, r.err, now
+		if r.chainID != 0 {
+			ep.chainID = r.chainID
+		}
+		switch {
+		case r.err != nil:
+		case p.chainID != 0 && ep.chainID != p.chainID:
+			ep.err = fmt.Errorf("chain id %d, want %d", ep.chainID, p.chainID)
+		case now.Sub(r.headTime) > p.maxBlockAge:
+			ep.err = fmt.Errorf("head block %d is %v old", r.height, now.Sub(r.headTime).Truncate(time.Second))
+		case best-r.height > p.maxBlockLag:
+			ep.err = fmt.Errorf("head block %d is %d blocks behind", r.height, best-r.height)
+		case p.maxLatency > 0 && r.latency > p.maxLatency:
+			ep.err = fmt.Errorf("head request took %v, max %v", r.latency.Truncate(time.Millisecond), p.maxLatency)
+		}
+		wasHealthy := ep.healthy
+		ep.healthy = ep.err == nil
+		if wasHealthy && !ep.healthy {
+			log.Warn("RPC endpoint unhealthy", "chain", p.chain, "url", ep.url, "err", ep.err)
+		} else if !wasHealthy && ep.healthy {
+			log.Info("RPC endpoint healthy", "chain", p.chain, "url", ep.url, "height", ep.height, "latency", ep.latency)
+		}
+	}
+	p.selectLocked()
+}
+
+// selectLocked switches to the first healthy endpoint in config order.
+func (p *clientPool) selectLocked() {
+	prev := p.current
+	p.current = -1
+	for i, ep := range p.endpoints {
+		if ep.healthy {
+			p.current = i
+			break
+		}
+	}
+	if p.current == prev {
+		return
+	}
+	if p.current < 0 {
+		log.Error("No healthy RPC endpoint", "chain", p.chain)
+		return
+	}
+	log.Info("Switched RPC endpoint", "chain", p.chain, "url", p.endpoints[p.current].url)
+}
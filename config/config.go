@@ -2,37 +2,229 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Config struct {
-	Coins       []Coins  `json:"coins"`
-	PrivatePath []string `json:"private_path"`
-	DebugLevel  int      `json:"debug_level"`
+	Chains      []Chain   `json:"chains"`
+	Consensus   Consensus `json:"consensus"`
+	History     History   `json:"history"`
+	HttpAddr    string    `json:"http_addr"`   // read-only API, disabled when empty
+	ReadyGrace  string    `json:"ready_grace"` // allowed delay past a heartbeat before /readyz fails
+	Alerting    Alerting  `json:"alerting"`
+	Coins       []Coins   `json:"coins"`
+	PrivatePath []string  `json:"private_path"`
+	DebugLevel  int       `json:"debug_level"`
 }
 
 type Coins struct {
-	Type        int    `json:"type"`
-	Url         string `json:"url"`
-	CzzAddress  string `json:"czz_address"`
-	EthfAddress string `json:"ethf_address"`
+	Name           string            `json:"name"`
+	Type           int               `json:"type"`
+	Source         string            `json:"source"`
+	Url            string            `json:"url"`
+	Headers        map[string]string `json:"headers"`
+	Sources        []Source          `json:"sources"`
+	OutlierBps     int64             `json:"outlier_bps"`
+	Quorum         int               `json:"quorum"`
+	DeviationBps   int64             `json:"deviation_bps"`
+	Heartbeat      string            `json:"heartbeat"`
+	Decimals       *uint8            `json:"decimals"`
+	OutOfRange     string            `json:"out_of_range"`
+	SignerStrategy string            `json:"signer_strategy"`
+	Targets        []Target          `json:"targets"`
+	CzzAddress     string            `json:"czz_address"`
+	EthfAddress    string            `json:"ethf_address"`
 }
 
+// Consensus configures the peer protocol between oracle nodes.
+type Consensus struct {
+	Enabled       bool   `json:"enabled"`
+	Listen        string `json:"listen"`       // address serving the peer endpoints
+	NodeAddress   string `json:"node_address"` // loaded key identifying this node, default the first
+	Peers         []Peer `json:"peers"`
+	Quorum        int    `json:"quorum"`         // observations and approvals required, default a majority
+	RoundTimeout  string `json:"round_timeout"`  // wait for missing observations
+	LeaderTimeout string `json:"leader_timeout"` // length of a transmitter slot
+}
+
+// History configures the embedded store of observations and transmissions.
+// It is disabled while Path is empty.
+type History struct {
+	Path      string `json:"path"`
+	Retention string `json:"retention"` // default 720h
+}
+
+// Alerting routes alerts to webhooks. Without rules every alert kind is
+// enabled with its default threshold.
+type Alerting struct {
+	Webhooks []Webhook   `json:"webhooks"`
+	Rules    []AlertRule `json:"rules"`
+	Renotify string      `json:"renotify"` // repeat a firing alert after this long, default 1h
+}
+
+// Webhook is an HTTP endpoint receiving alerts as POSTed JSON.
+type Webhook struct {
+	Name     string            `json:"name"`
+	Url      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	Template string            `json:"template"` // text/template rendering the body, default the alert as JSON
+	Kinds    []string          `json:"kinds"`    // alert kinds delivered, empty for all
+}
+
+// AlertRule enables an alert kind, optionally for one feed only.
+type AlertRule struct {
+	Kind      string  `json:"kind"`
+	Feed      string  `json:"feed"`      // empty matches every feed
+	Threshold float64 `json:"threshold"` // failed transmits, disagreement percent or balance, by kind
+	Renotify  string  `json:"renotify"`  // overrides Alerting.Renotify
+}
+
+// Peer is another oracle node.
+type Peer struct {
+	Url     string `json:"url"`
+	Address string `json:"address"`
+}
+
+// Chain is an EVM network the oracle writes to.
+type Chain struct {
+	Name           string    `json:"name"`
+	RpcUrls        []string  `json:"rpc_urls"`
+	ChainId        uint64    `json:"chain_id"`
+	Gas            GasPolicy `json:"gas"`
+	HealthInterval string    `json:"health_interval"`
+	MaxBlockAge    string    `json:"max_block_age"`
+	MaxBlockLag    uint64    `json:"max_block_lag"`
+	MaxLatency     string    `json:"max_latency"`     // slowest acceptable head request, empty disables
+	MinBalance     float64   `json:"min_balance"`     // signer balance in native coin below which /readyz fails
+	MinRunwayDays  float64   `json:"min_runway_days"` // warn when a signer balance lasts fewer days, 0 disables
+}
+
+// GasPolicy controls how transactions on a chain are priced.
+type GasPolicy struct {
+	PricePercent     int     `json:"price_percent"`      // percent of the suggested legacy gas price, 0 means 100
+	GasLimit         uint64  `json:"gas_limit"`          // 0 estimates the limit
+	GasMarginPercent int     `json:"gas_margin_percent"` // added to the estimate, 0 means 20
+	Legacy           bool    `json:"legacy"`             // never send dynamic fee transactions
+	BaseFeePercent   int     `json:"base_fee_percent"`   // fee cap as percent of the base fee on top of the tip, 0 means 200
+	MaxFeeGwei       float64 `json:"max_fee_gwei"`       // upper bound of gas price or fee cap, 0 means unbounded
+	MaxTipGwei       float64 `json:"max_tip_gwei"`       // upper bound of the priority fee, 0 means unbounded
+	TxTimeout        string  `json:"tx_timeout"`         // wait before bumping an unmined transaction
+	BumpPercent      int     `json:"bump_percent"`       // fee increase per bump, at least 10
+	MaxBumps         int     `json:"max_bumps"`          // bumps before the nonce is cancelled
+}
+
+// Target is an aggregator contract a feed writes to.
+type Target struct {
+	Chain     string `json:"chain"`
+	Address   string `json:"address"`
+	FromBlock uint64 `json:"from_block"` // first block searched for ConfigSet events
+}
+
+// Source is one upstream price API of a feed.
+type Source struct {
+	Id      string            `json:"id"`
+	Name    string            `json:"name"`
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// ID returns the identifier used for the source in logs.
+func (s Source) ID() string {
+	if s.Id != "" {
+		return s.Id
+	}
+	return s.Name
+}
+
+// SourceName returns the price source adapter of the feed. Configs written
+// before sources were named select the adapter through Type.
+func (c Coins) SourceName() string {
+	if c.Source != "" {
+		return c.Source
+	}
+	switch c.Type {
+	case 1:
+		return "candlestick"
+	case 2:
+		return "ave"
+	}
+	return ""
+}
+
+// SourceList returns the configured sources of the feed, falling back to
+// the single url/source pair of older configs.
+func (c Coins) SourceList() []Source {
+	if len(c.Sources) > 0 {
+		return c.Sources
+	}
+	return []Source{{Name: c.SourceName(), Url: c.Url, Headers: c.Headers}}
+}
+
+// TargetList returns the aggregators of the feed. The czz_address and
+// ethf_address fields of older configs map to the "czz" and "ethf" chains.
+func (c Coins) TargetList() []Target {
+	targets := append([]Target(nil), c.Targets...)
+	if c.CzzAddress != "" {
+		targets = append(targets, Target{Chain: "czz", Address: c.CzzAddress})
+	}
+	if c.EthfAddress != "" {
+		targets = append(targets, Target{Chain: "ethf", Address: c.EthfAddress})
+	}
+	return targets
+}
+
+// FeedName returns a human readable identifier for logs.
+func (c Coins) FeedName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if targets := c.TargetList(); len(targets) > 0 {
+		return targets[0].Address
+	}
+	return ""
+}
+
+// Chain returns the chain configured as name.
+func (cfg *Config) Chain(name string) (Chain, bool) {
+	for _, c := range cfg.Chains {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Chain{}, false
+}
+
+// ParseDuration parses a duration option such as "10m" or "24h", returning
+// def for an empty string.
+func ParseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("non-positive duration %v", d)
+	}
+	return d, nil
+}
+
+// LoadConfig reads the config file filep, or config.json when filep is empty.
 func LoadConfig(cfg *Config, filep string) {
 
 	// Default config.
 	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+	if filep != "" {
+		configFileName = filep
 	}
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
 
-	if filep != "" {
-		configFileName = filep
-	}
 	configFile, err := os.Open(configFileName)
 	if err != nil {
 		log.Fatal("File error: ", err.Error())
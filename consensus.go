@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/common/hexutil"
+	"github.com/classzz/go-classzz-v2/crypto"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+const (
+	defaultRoundTimeout   = 10 * time.Second
+	defaultLeaderTimeout  = 2 * time.Minute
+	maxObservationAge     = 2 * time.Minute
+	consensusHTTPTimeout  = 5 * time.Second
+	consensusObservePath  = "/consensus/observe"
+	consensusReportPath   = "/consensus/report"
+	maxConsensusBodyBytes = 1 << 20
+)
+
+// consensus is the peer protocol of this node, nil when disabled.
+var consensus *consensusNode
+
+// signedObservation is the answer one node observed for a round of a target.
+type signedObservation struct {
+	Feed      string         `json:"feed"`
+	Target    string         `json:"target"`
+	Round     uint32         `json:"round"`
+	Answer    *hexutil.Big   `json:"answer"`
+	Timestamp int64          `json:"timestamp"`
+	Signer    common.Address `json:"signer"`
+	Signature hexutil.Bytes  `json:"signature"`
+}
+
+func (o *signedObservation) hash() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("observation")
+	writeRoundKey(&buf, o.Feed, o.Target, o.Round)
+	buf.Write(common.LeftPadBytes(o.Answer.ToInt().Bytes(), 32))
+	binary.Write(&buf, binary.BigEndian, o.Timestamp)
+	return crypto.Keccak256(buf.Bytes())
+}
+
+// consensusReport is the median the elected transmitter proposes for a round,
+// with the observations it was computed from.
+type consensusReport struct {
+	Feed         string               `json:"feed"`
+	Target       string               `json:"target"`
+	Round        uint32               `json:"round"`
+	Answer       *hexutil.Big         `json:"answer"`
+	Transmitter  common.Address       `json:"transmitter"`
+	Observations []*signedObservation `json:"observations"`
+}
+
+func (r *consensusReport) hash() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("report")
+	writeRoundKey(&buf, r.Feed, r.Target, r.Round)
+	buf.Write(common.LeftPadBytes(r.Answer.ToInt().Bytes(), 32))
+	buf.Write(r.Transmitter.Bytes())
+	return crypto.Keccak256(buf.Bytes())
+}
+
+// reportApproval is a node's signature over a report it verified.
+type reportApproval struct {
+	Signer    common.Address `json:"signer"`
+	Signature hexutil.Bytes  `json:"signature"`
+}
+
+func writeRoundKey(buf *bytes.Buffer, feed, target string, round uint32) {
+	buf.WriteString(feed)
+	buf.WriteByte(0)
+	buf.WriteString(target)
+	buf.WriteByte(0)
+	binary.Write(buf, binary.BigEndian, round)
+}
+
+type roundKey struct {
+	feed   string
+	target string
+	round  uint32
+}
+
+// consensusNode exchanges signed observations with the configured peers.
+// For every round the members agree on a transmitter, chosen from the sorted
+// member addresses by round id and leader slot; only that node transmits,
+// after a quorum of members approved its median report. Leader slots last
+// leader_timeout counted from the last on-chain update, so a silent leader
+// is replaced by the next member.
+type consensusNode struct {
+	self          *signer
+	members       []common.Address // sorted, including self
+	peers         []config.Peer
+	quorum        int
+	roundTimeout  time.Duration
+	leaderTimeout time.Duration
+	client        *http.Client
+
+	mu           sync.Mutex
+	observations map[roundKey]map[common.Address]*signedObservation
+}
+
+func newConsensusNode(c config.Consensus, signers []*signer) (*consensusNode, error) {
+	if len(signers) == 0 {
+		return nil, errors.New("consensus needs a signing key")
+	}
+	self := signers[0]
+	if c.NodeAddress != "" {
+		self = nil
+		for _, s := range signers {
+			if s.address == common.HexToAddress(c.NodeAddress) {
+				self = s
+			}
+		}
+		if self == nil {
+			return nil, fmt.Errorf("node_address %s is not a loaded key", c.NodeAddress)
+		}
+	}
+	roundTimeout, err := config.ParseDuration(c.RoundTimeout, defaultRoundTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("round_timeout: %v", err)
+	}
+	leaderTimeout, err := config.ParseDuration(c.LeaderTimeout, defaultLeaderTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("leader_timeout: %v", err)
+	}
+	n := &consensusNode{
+		self:          self,
+		members:       []common.Address{self.address},
+		peers:         c.Peers,
+		quorum:        c.Quorum,
+		roundTimeout:  roundTimeout,
+		leaderTimeout: leaderTimeout,
+		client:        &http.Client{Timeout: consensusHTTPTimeout},
+		observations:  make(map[roundKey]map[common.Address]*signedObservation),
+	}
+	for _, p := range c.Peers {
+		if !common.IsHexAddress(p.Address) {
+			return nil, fmt.Errorf("peer %s: invalid address %q", p.Url, p.Address)
+		}
+		n.members = append(n.members, common.HexToAddress(p.Address))
+	}
+	sort.Slice(n.members, func(i, j int) bool { return bytes.Compare(n.members[i][:], n.members[j][:]) < 0 })
+	if n.quorum == 0 {
+		n.quorum = len(n.members)/2 + 1
+	}
+	if n.quorum > len(n.members) {
+		return nil, fmt.Errorf("quorum %d exceeds %d members", n.quorum, len(n.members))
+	}
+	return n, nil
+}
+
+// handler serves the peer endpoints.
+func (n *consensusNode) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(consensusObservePath, n.serveObserve)
+	mux.HandleFunc(consensusReportPath, n.serveReport)
+	return mux
+}
+
+// listen serves the peer protocol on addr.
+func (n *consensusNode) listen(addr string) {
+	log.Info("Consensus listening", "addr", addr, "node", n.self.address, "members", len(n.members), "quorum", n.quorum)
+	if err := http.ListenAndServe(addr, n.handler()); err != nil {
+		log.Error("Consensus server stopped", "err", err)
+	}
+}
+
+func (n *consensusNode) isMember(addr common.Address) bool {
+	for _, m := range n.members {
+		if m == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// leader returns the member that transmits round in the given leader slot.
+func (n *consensusNode) leader(round uint32, slot int64) common.Address {
+	return n.members[(int64(round)+slot)%int64(len(n.members))]
+}
+
+// verify checks that o is signed by its claimed member.
+func (n *consensusNode) verify(o *signedObservation) error {
+	if o.Answer == nil {
+		return errors.New("missing answer")
+	}
+	if !n.isMember(o.Signer) {
+		return fmt.Errorf("%s is not a member", o.Signer)
+	}
+	pub, err := crypto.SigToPub(o.hash(), o.Signature)
+	if err != nil {
+		return err
+	}
+	if crypto.PubkeyToAddress(*pub) != o.Signer {
+		return fmt.Errorf("bad signature from %s", o.Signer)
+	}
+	return nil
+}
+
+// store keeps o unless a newer observation of the same signer is known.
+func (n *consensusNode) store(o *signedObservation) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxObservationAge).Unix()
+	for key, obs := range n.observations {
+		for addr, old := range obs {
+			if old.Timestamp < cutoff {
+				delete(obs, addr)
+			}
+		}
+		if len(obs) == 0 {
+			delete(n.observations, key)
+		}
+	}
+	key := roundKey{o.Feed, o.Target, o.Round}
+	obs, ok := n.observations[key]
+	if !ok {
+		obs = make(map[common.Address]*signedObservation)
+		n.observations[key] = obs
+	}
+	if old, ok := obs[o.Signer]; !ok || old.Timestamp <= o.Timestamp {
+		obs[o.Signer] = o
+	}
+}
+
+// collected returns the fresh observations known for key.
+func (n *consensusNode) collected(key roundKey) []*signedObservation {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cutoff := time.Now().Add(-maxObservationAge).Unix()
+	var res []*signedObservation
+	for _, o := range n.observations[key] {
+		if o.Timestamp >= cutoff {
+			res = append(res, o)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return bytes.Compare(res[i].Signer[:], res[j].Signer[:]) < 0 })
+	return res
+}
+
+func (n *consensusNode) serveObserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var o signedObservation
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConsensusBodyBytes)).Decode(&o); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := n.verify(&o); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	n.store(&o)
+	log.Debug("Peer observation", "feed", o.Feed, "target", o.Target, "round", o.Round, "signer", o.Signer, "answer", o.Answer.ToInt())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (n *consensusNode) serveReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var rep consensusReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConsensusBodyBytes)).Decode(&rep); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := n.checkReport(&rep); err != nil {
+		log.Warn("Rejected consensus report", "feed", rep.Feed, "target", rep.Target, "round", rep.Round, "transmitter", rep.Transmitter, "err", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	sig, err := crypto.Sign(rep.hash(), n.self.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&reportApproval{Signer: n.self.address, Signature: sig})
+}
+
+// checkReport verifies a report proposed by another member: its round must be
+// one this node observed, its observations must be signed by distinct members
+// for that round, and its answer must be their median.
+func (n *consensusNode) checkReport(rep *consensusReport) error {
+	if rep.Answer == nil {
+		return errors.New("missing answer")
+	}
+	if !n.isMember(rep.Transmitter) {
+		return fmt.Errorf("transmitter %s is not a member", rep.Transmitter)
+	}
+	if own := n.collected(roundKey{rep.Feed, rep.Target, rep.Round}); !containsSigner(own, n.self.address) {
+		return fmt.Errorf("round %d not observed by this node", rep.Round)
+	}
+	if len(rep.Observations) < n.quorum {
+		return fmt.Errorf("%d observations, quorum %d", len(rep.Observations), n.quorum)
+	}
+	seen := make(map[common.Address]bool)
+	for _, o := range rep.Observations {
+		if o.Feed != rep.Feed || o.Target != rep.Target || o.Round != rep.Round {
+			return fmt.Errorf("observation of %s for another round", o.Signer)
+		}
+		if seen[o.Signer] {
+			return fmt.Errorf("duplicate observation of %s", o.Signer)
+		}
+		seen[o.Signer] = true
+		if err := n.verify(o); err != nil {
+			return err
+		}
+	}
+	if median := medianAnswer(rep.Observations); median.Cmp(rep.Answer.ToInt()) != 0 {
+		return fmt.Errorf("answer %v is not the median %v", rep.Answer.ToInt(), median)
+	}
+	return nil
+}
+
+func containsSigner(obs []*signedObservation, addr common.Address) bool {
+	for _, o := range obs {
+		if o.Signer == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// medianAnswer returns the median answer of obs, rounding the mean of the two
+// middle answers down for an even count.
+func medianAnswer(obs []*signedObservation) *big.Int {
+	answers := make([]*big.Int, len(obs))
+	for i, o := range obs {
+		answers[i] = o.Answer.ToInt()
+	}
+	sort.Slice(answers, func(i, j int) bool { return answers[i].Cmp(answers[j]) < 0 })
+	k := len(answers)
+	if k%2 == 1 {
+		return new(big.Int).Set(answers[k/2])
+	}
+	sum := new(big.Int).Add(answers[k/2-1], answers[k/2])
+	return sum.Div(sum, big.NewInt(2))
+}
+
+// agree shares this node's answer for round of target t with the peers. It
+// returns the agreed median when this node is the round's transmitter and a
+// quorum approved the report, and false otherwise.
+func (n *consensusNode) agree(ctx context.Context, feed string, t *aggregatorTarget, round uint32, answer *big.Int, updatedAt time.Time) (*big.Int, bool) {
+	own := &signedObservation{
+		Feed:      feed,
+		Target:    t.String(),
+		Round:     round,
+		Answer:    (*hexutil.Big)(answer),
+		Timestamp: time.Now().Unix(),
+		Signer:    n.self.address,
+	}
+	sig, err := crypto.Sign(own.hash(), n.self.key)
+	if err != nil {
+		log.Error("Failed to sign observation", "err", err)
+		return nil, false
+	}
+	own.Signature = sig
+	n.store(own)
+	n.broadcast(ctx, consensusObservePath, own, nil)
+
+	// A chain clock ahead of ours would give a negative slot.
+	slot := int64(time.Since(updatedAt) / n.leaderTimeout)
+	if slot < 0 {
+		slot = 0
+	}
+	leader := n.leader(round, slot)
+	if leader != n.self.address {
+		log.Debug("Peer transmits round", "feed", feed, "target", t, "round", round, "leader", leader, "slot", slot)
+		return nil, false
+	}
+
+	key := roundKey{feed, t.String(), round}
+	obs := n.collected(key)
+	if len(obs) < n.quorum {
+		select {
+		case <-time.After(n.roundTimeout):
+		case <-ctx.Done():
+			return nil, false
+		}
+		obs = n.collected(key)
+	}
+	if len(obs) < n.quorum {
+		log.Warn("Consensus quorum not reached", "feed", feed, "target", t, "round", round, "observations", len(obs), "quorum", n.quorum)
+		return nil, false
+	}
+
+	rep := &consensusReport{
+		Feed:         feed,
+		Target:       t.String(),
+		Round:        round,
+		Answer:       (*hexutil.Big)(medianAnswer(obs)),
+		Transmitter:  n.self.address,
+		Observations: obs,
+	}
+	var (
+		mu        sync.Mutex
+		approvals = 1 // our own
+	)
+	n.broadcast(ctx, consensusReportPath, rep, func(peer config.Peer, body []byte) {
+		var a reportApproval
+		if err := json.Unmarshal(body, &a); err != nil {
+			return
+		}
+		pub, err := crypto.SigToPub(rep.hash(), a.Signature)
+		if err != nil || crypto.PubkeyToAddress(*pub) != a.Signer || a.Signer != common.HexToAddress(peer.Address) {
+			log.Warn("Invalid report approval", "peer", peer.Url)
+			return
+		}
+		mu.Lock()
+		approvals++
+		mu.Unlock()
+	})
+	if approvals < n.quorum {
+		log.Warn("Consensus report not approved", "feed", feed, "target", t, "round", round, "approvals", approvals, "quorum", n.quorum)
+		return nil, false
+	}
+	log.Info("Consensus reached", "feed", feed, "target", t, "round", round, "answer", rep.Answer.ToInt(), "observations", len(obs), "approvals", approvals)
+	return rep.Answer.ToInt(), true
+}
+
+// broadcast posts msg to every peer concurrently and waits for the answers,
+// passing successful response bodies to onReply.
+func (n *consensusNode) broadcast(ctx context.Context, path string, msg interface{}, onReply func(config.Peer, []byte)) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		log.Error("Failed to encode consensus message", "err", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range n.peers {
+		wg.Add(1)
+		go func(peer config.Peer) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer.Url+path, bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := n.client.Do(req)
+			if err != nil {
+				log.Debug("Consensus peer unreachable", "peer", peer.Url, "err", err)
+				return
+			}
+			defer resp.Body.Close()
+			var buf bytes.Buffer
+			buf.ReadFrom(http.MaxBytesReader(nil, resp.Body, maxConsensusBodyBytes))
+			if resp.StatusCode/100 != 2 {
+				log.Debug("Consensus peer refused", "peer", peer.Url, "path", path, "status", resp.Status, "body", bytes.TrimSpace(buf.Bytes()))
+				return
+			}
+			if onReply != nil {
+				onReply(peer, buf.Bytes())
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/common/hexutil"
+	"github.com/classzz/go-classzz-v2/crypto"
+)
+
+const testFeed = "BTC/USD"
+
+var testTarget = &aggregatorTarget{chain: &evmChain{name: "czz"}, address: common.Address{1}}
+
+// testCluster is a set of consensus nodes serving each other on loopback.
+type testCluster struct {
+	nodes   []*consensusNode
+	servers []*httptest.Server
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	t.Helper()
+	c := &testCluster{nodes: make([]*consensusNode, size)}
+	signers := make([]*signer, size)
+	for i := range signers {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[i] = newSigners([]*ecdsa.PrivateKey{key})[0]
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.nodes[i].handler().ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		c.servers = append(c.servers, srv)
+	}
+	for i := range c.nodes {
+		var peers []config.Peer
+		for j, srv := range c.servers {
+			if j != i {
+				peers = append(peers, config.Peer{Url: srv.URL, Address: signers[j].address.Hex()})
+			}
+		}
+		node, err := newConsensusNode(config.Consensus{Peers: peers, RoundTimeout: "100ms"}, signers[i:i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.nodes[i] = node
+	}
+	return c
+}
+
+// byAddress returns the node identified by addr.
+func (c *testCluster) byAddress(addr common.Address) *consensusNode {
+	for _, n := range c.nodes {
+		if n.self.address == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+// observe signs answer for round by n and stores it at every node.
+func (c *testCluster) observe(t *testing.T, n *consensusNode, round uint32, answer int64) *signedObservation {
+	t.Helper()
+	o := &signedObservation{
+		Feed:      testFeed,
+		Target:    testTarget.String(),
+		Round:     round,
+		Answer:    (*hexutil.Big)(big.NewInt(answer)),
+		Timestamp: time.Now().Unix(),
+		Signer:    n.self.address,
+	}
+	sig, err := crypto.Sign(o.hash(), n.self.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Signature = sig
+	for _, m := range c.nodes {
+		m.store(o)
+	}
+	return o
+}
+
+func post(t *testing.T, url string, msg interface{}) int {
+	t.Helper()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestConsensusDefaultQuorum(t *testing.T) {
+	c := newTestCluster(t, 3)
+	for _, n := range c.nodes {
+		if n.quorum != 2 {
+			t.Fatalf("quorum %d, want 2 of 3 members", n.quorum)
+		}
+		if len(n.members) != 3 {
+			t.Fatalf("%d members, want 3", len(n.members))
+		}
+	}
+}
+
+func TestConsensusLeaderElection(t *testing.T) {
+	c := newTestCluster(t, 3)
+	const round = 7
+	leader := c.nodes[0].leader(round, 0)
+	for _, n := range c.nodes {
+		if got := n.leader(round, 0); got != leader {
+			t.Fatalf("node %s elects %s, node %s elects %s", n.self.address, got, c.nodes[0].self.address, leader)
+		}
+	}
+	if next := c.nodes[0].leader(round, 1); next == leader {
+		t.Fatalf("next leader slot elects %s again", leader)
+	}
+
+	// Members that do not lead share their observation and return at once.
+	answers := []int64{100, 300, 200}
+	updatedAt := time.Now()
+	var leaderAnswer int64
+	for i, n := range c.nodes {
+		if n.self.address == leader {
+			leaderAnswer = answers[i]
+			continue
+		}
+		if _, ok := n.agree(context.Background(), testFeed, testTarget, round, big.NewInt(answers[i]), updatedAt); ok {
+			t.Fatalf("node %s agreed without leading round %d", n.self.address, round)
+		}
+	}
+	answer, ok := c.byAddress(leader).agree(context.Background(), testFeed, testTarget, round, big.NewInt(leaderAnswer), updatedAt)
+	if !ok {
+		t.Fatal("leader did not reach consensus")
+	}
+	if answer.Cmp(big.NewInt(200)) != 0 {
+		t.Fatalf("agreed answer %v, want median 200", answer)
+	}
+}
+
+func TestConsensusQuorumNotReached(t *testing.T) {
+	c := newTestCluster(t, 3)
+	const round = 8
+	leader := c.byAddress(c.nodes[0].leader(round, 0))
+	if _, ok := leader.agree(context.Background(), testFeed, testTarget, round, big.NewInt(100), time.Now()); ok {
+		t.Fatal("leader agreed on its own observation alone")
+	}
+}
+
+func TestConsensusRejectsNonMedianReport(t *testing.T) {
+	c := newTestCluster(t, 3)
+	const round = 9
+	var obs []*signedObservation
+	for i, n := range c.nodes {
+		obs = append(obs, c.observe(t, n, round, int64(100*(i+1))))
+	}
+	report := func(answer int64) *consensusReport {
+		return &consensusReport{
+			Feed:         testFeed,
+			Target:       testTarget.String(),
+			Round:        round,
+			Answer:       (*hexutil.Big)(big.NewInt(answer)),
+			Transmitter:  c.nodes[0].self.address,
+			Observations: obs,
+		}
+	}
+	if err := c.nodes[1].checkReport(report(200)); err != nil {
+		t.Fatalf("median report rejected: %v", err)
+	}
+	err := c.nodes[1].checkReport(report(300))
+	if err == nil || !strings.Contains(err.Error(), "not the median") {
+		t.Fatalf("non-median report: got %v, want median error", err)
+	}
+	if code := post(t, c.servers[1].URL+consensusReportPath, report(300)); code != http.StatusConflict {
+		t.Fatalf("non-median report served with %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestConsensusRejectsBadSignature(t *testing.T) {
+	c := newTestCluster(t, 3)
+	const round = 10
+	o := c.observe(t, c.nodes[0], round, 100)
+
+	// Signed by another member than the one it claims.
+	forged := *o
+	forged.Signer = c.nodes[1].self.address
+	if err := c.nodes[2].verify(&forged); err == nil {
+		t.Fatal("observation with a foreign signature verified")
+	}
+	if code := post(t, c.servers[2].URL+consensusObservePath, &forged); code != http.StatusForbidden {
+		t.Fatalf("forged observation served with %d, want %d", code, http.StatusForbidden)
+	}
+
+	// Tampered with after signing.
+	tampered := *o
+	tampered.Answer = (*hexutil.Big)(big.NewInt(1000))
+	if code := post(t, c.servers[2].URL+consensusObservePath, &tampered); code != http.StatusForbidden {
+		t.Fatalf("tampered observation served with %d, want %d", code, http.StatusForbidden)
+	}
+
+	// A report carrying the forged observation is refused as well.
+	rep := &consensusReport{
+		Feed:         testFeed,
+		Target:       testTarget.String(),
+		Round:        round,
+		Answer:       (*hexutil.Big)(big.NewInt(100)),
+		Transmitter:  c.nodes[0].self.address,
+		Observations: []*signedObservation{o, &forged},
+	}
+	if err := c.nodes[0].checkReport(rep); err == nil {
+		t.Fatal("report with a forged observation accepted")
+	}
+}
+
+func TestConsensusChainClockAhead(t *testing.T) {
+	c := newTestCluster(t, 3)
+	const round = 11
+	n := c.byAddress(c.nodes[0].leader(round, 0))
+	// An update time further in the future than leader_timeout stays in the
+	// first leader slot.
+	updatedAt := time.Now().Add(100 * n.leaderTimeout)
+	if _, ok := n.agree(context.Background(), testFeed, testTarget, round, big.NewInt(100), updatedAt); ok {
+		t.Fatal("leader agreed on its own observation alone")
+	}
+}
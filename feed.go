@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/core/types"
+	"github.com/classzz/go-classzz-v2/czzclient"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+// feed is one configured price pair and everything needed to keep its
+// aggregators up to date.
+type feed struct {
+	coin    config.Coins
+	name    string
+	sources *sourceSet
+	policy  *updatePolicy
+	targets []*aggregatorTarget
+
+	mu           sync.Mutex
+	observations map[string]*sourceStatus // latest outcome per source id
+	median       *big.Rat
+	aggregatedAt time.Time
+	aggErr       error
+}
+
+// sourceStatus is the latest outcome of one price source.
+type sourceStatus struct {
+	Source   string    `json:"source"`
+	Price    string    `json:"price,omitempty"`
+	Rejected bool      `json:"rejected,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Out of range policies.
+const (
+	outOfRangeSkip  = "skip"
+	outOfRangeClamp = "clamp"
+	outOfRangePause = "pause"
+)
+
+func newFeed(coin config.Coins, chains map[string]*evmChain) (*feed, error) {
+	sources, err := newSourceSet(coin)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := newUpdatePolicy(coin)
+	if err != nil {
+		return nil, err
+	}
+	switch coin.OutOfRange {
+	case "", outOfRangeSkip, outOfRangeClamp, outOfRangePause:
+	default:
+		return nil, fmt.Errorf("unknown out_of_range policy %q", coin.OutOfRange)
+	}
+	f := &feed{
+		coin:         coin,
+		name:         coin.FeedName(),
+		sources:      sources,
+		policy:       policy,
+		observations: make(map[string]*sourceStatus),
+	}
+	for _, tc := range coin.TargetList() {
+		chain, ok := chains[tc.Chain]
+		if !ok {
+			return nil, fmt.Errorf("target %s: unknown chain %q", tc.Address, tc.Chain)
+		}
+		if !common.IsHexAddress(tc.Address) {
+			return nil, fmt.Errorf("target on %s: invalid address %q", tc.Chain, tc.Address)
+		}
+		target := &aggregatorTarget{
+			feed:      f.name,
+			chain:     chain,
+			address:   common.HexToAddress(tc.Address),
+			fromBlock: tc.FromBlock,
+			want:      coin.Decimals,
+		}
+		if target.selector, err = newSignerSelector(coin.SignerStrategy); err != nil {
+			return nil, err
+		}
+		registerTargetMetrics(f.name, target)
+		f.targets = append(f.targets, target)
+	}
+	if len(f.targets) == 0 {
+		return nil, fmt.Errorf("no targets")
+	}
+	return f, nil
+}
+
+func (f *feed) run(signers []*signer) {
+
+	addrs := make([]common.Address, len(signers))
+	for i, s := range signers {
+		addrs[i] = s.address
+	}
+	for _, t := range f.targets {
+		go f.start(t, addrs)
+		go t.watchState(f.name)
+	}
+
+	startTicker := time.NewTicker(startInterval)
+	for {
+		select {
+		case <-startTicker.C:
+			report, err := f.sources.aggregate(context.Background())
+			f.observe(report, err)
+			observeAggregate(f.name, report, err)
+			if err == nil {
+				f.checkDisagreement(report)
+			}
+			history.recordAggregate(f.name, report, err)
+			for id, err := range report.Errors {
+				log.Warn("Price source failed", "feed", f.name, "source", id, "err", err)
+			}
+			for _, o := range report.Rejected {
+				log.Warn("Price source rejected as outlier", "feed", f.name, "source", o.Source, "price", o.Price.FloatString(8))
+			}
+			if err != nil {
+				log.Error("runFeed", "feed", f.name, "err", err)
+				continue
+			}
+			log.Debug("Aggregated price", "feed", f.name, "median", report.Median.FloatString(8), "sources", len(report.Accepted))
+
+			var wg sync.WaitGroup
+			for _, t := range f.targets {
+				if !t.ready() {
+					log.Debug("Target loading, paused or transmission pending", "feed", f.name, "target", t)
+					countSkip(f.name, skipBusy)
+					continue
+				}
+				wg.Add(1)
+				go func(t *aggregatorTarget) {
+					defer wg.Done()
+					f.send(t, signers, report.Median, 0)
+				}(t)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// start reads the parameters and signers of t, retrying with backoff while
+// the chain cannot be read, and then lets ticks transmit to it.
+func (f *feed) start(t *aggregatorTarget, addrs []common.Address) {
+	for wait := targetRetryMin; ; {
+		err := t.loadParams()
+		if err == nil {
+			break
+		}
+		log.Error("Failed to load aggregator, retrying", "feed", f.name, "target", t, "retry", wait, "err", err)
+		time.Sleep(wait)
+		if wait *= 2; wait > targetRetryMax {
+			wait = targetRetryMax
+		}
+	}
+	// The scan only holds back transmissions to t; other targets and feeds
+	// run meanwhile.
+	if t.fromBlock == 0 {
+		log.Warn("Scanning aggregator signers from genesis, set from_block to the deployment block", "feed", f.name, "target", t)
+	}
+	from := t.fromBlock
+	for attempt := 1; ; attempt++ {
+		err := t.loadSigners(context.Background(), from)
+		if err == nil {
+			break
+		}
+		if attempt == signerScanAttempts {
+			log.Warn("Failed to read aggregator signers, using every key", "feed", f.name, "target", t, "err", err)
+			break
+		}
+		log.Warn("Failed to read aggregator signers, retrying", "feed", f.name, "target", t, "retry", targetRetryMin, "err", err)
+		time.Sleep(targetRetryMin)
+		// Windows already scanned are not read again.
+		t.signers.mu.RLock()
+		if t.signers.scanned > 0 && t.signers.scanned >= from {
+			from = t.signers.scanned + 1
+		}
+		t.signers.mu.RUnlock()
+	}
+	t.reportSigners(f.name, addrs)
+	go t.watchSigners(f.name, addrs)
+	t.setLoaded()
+	log.Info("Aggregator loaded", "feed", f.name, "target", t, "decimals", t.decimals, "min", t.minAnswer, "max", t.maxAnswer)
+}
+
+// Backoff of start while an aggregator cannot be read.
+const (
+	targetRetryMin     = 5 * time.Second
+	targetRetryMax     = 5 * time.Minute
+	signerScanAttempts = 3
+)
+
+// maxRoundRetries bounds how often send starts over after another
+// transmission advanced the round first.
+const maxRoundRetries = 3
+
+// observe keeps the outcome of an aggregation round for the API.
+func (f *feed) observe(report *aggregateReport, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for _, o := range report.Accepted {
+		f.observations[o.Source] = &sourceStatus{Source: o.Source, Price: o.Price.FloatString(8), Time: o.Timestamp}
+	}
+	for _, o := range report.Rejected {
+		f.observations[o.Source] = &sourceStatus{Source: o.Source, Price: o.Price.FloatString(8), Rejected: true, Time: o.Timestamp}
+	}
+	for id, err := range report.Errors {
+		f.observations[id] = &sourceStatus{Source: id, Error: err.Error(), Time: now}
+	}
+	f.aggregatedAt, f.aggErr = now, err
+	if err == nil {
+		f.median = report.Median
+	}
+}
+
+// send transmits price to t when the update policy asks for a new round.
+// attempt counts the retries after losing a round race.
+func (f *feed) send(t *aggregatorTarget, signers []*signer, price *big.Rat, attempt int) {
+
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		log.Error("NewClient", "feed", f.name, "target", t, "err", err)
+		return
+	}
+
+	instance, err := NewAggregator(t.address, client)
+	if err != nil {
+		log.Error("NewAggregator", "feed", f.name, "target", t, "err", err)
+		return
+	}
+	latest, err := t.latestRound(context.TODO(), client)
+	if err != nil {
+		log.Error("LatestRoundData", "feed", f.name, "target", t, "err", err)
+		t.chain.pool.reportFailure(client, err)
+		return
+	}
+	if latest.Answer == nil {
+		return
+	}
+
+	log.Info("send", "feed", f.name, "latestRound", latest.Round, "target", t)
+
+	rateInt, ok := f.checkRange(t, t.scale(price))
+	if !ok {
+		countSkip(f.name, skipOutOfRange)
+		return
+	}
+
+	updatedAt := latest.UpdatedAt
+	decision := f.policy.decide(rateInt, latest.Answer, updatedAt, time.Now())
+	history.recordDecision(f.name, t, latest, rateInt, decision)
+	observeRound(f.name, t, latest, decision)
+	if !decision.Submit {
+		countSkip(f.name, skipPolicy)
+		log.Debug("Skipping round", "feed", f.name, "target", t, "reason", decision.Reason, "deviation_bps", decision.DeviationBps, "age", decision.Age)
+		return
+	}
+	log.Info("Submitting round", "feed", f.name, "target", t, "reason", decision.Reason, "deviation_bps", decision.DeviationBps, "age", decision.Age)
+
+	round := latest.Round + 1
+
+	if consensus != nil {
+		agreed, ok := consensus.agree(context.TODO(), f.name, t, round, rateInt, updatedAt)
+		if !ok {
+			countSkip(f.name, skipConsensus)
+			return
+		}
+		if rateInt, ok = f.checkRange(t, agreed); !ok {
+			countSkip(f.name, skipOutOfRange)
+			return
+		}
+	}
+
+	var candidates []*signer
+	for _, s := range signers {
+		if t.signerEnabled(s.address) {
+			candidates = append(candidates, s)
+		}
+	}
+	if dryRun {
+		f.dryRunTransmit(t, client, candidates, round, rateInt)
+		return
+	}
+	picked := t.selector.pick(context.TODO(), client, balances.affordable(t.chain.name, candidates))
+	if len(picked) == 0 {
+		log.Error("No usable signer", "feed", f.name, "target", t, "loaded", len(signers), "authorized", len(candidates))
+		countSkip(f.name, skipNoSigner)
+		return
+	}
+	if len(picked) > 1 {
+		f.transmitAll(t, picked, instance, client, round, rateInt)
+		return
+	}
+	f.transmit(t, picked[0], instance, client, round, rateInt, nil, func() {
+		// The round moved on under us: read the new on-chain answer and let
+		// the update policy decide again whether ours is still needed.
+		if attempt >= maxRoundRetries {
+			log.Warn("Giving up on round race", "feed", f.name, "target", t, "round", round, "attempts", attempt+1)
+			return
+		}
+		log.Info("Round advanced before transmission, re-evaluating", "feed", f.name, "target", t, "round", round, "attempt", attempt+1)
+		t.state.invalidate()
+		f.send(t, signers, price, attempt+1)
+	})
+}
+
+// transmit sends answer for round to t from s. batch is set when several
+// signers transmit the round. retry, if set, is called instead of reporting a
+// failure when another transmission filled the round first, whether that is
+// seen in simulation or in the receipt.
+func (f *feed) transmit(t *aggregatorTarget, s *signer, instance *Aggregator, client *czzclient.Client, round uint32, answer *big.Int, batch *roundBatch, retry func()) {
+	t.begin()
+	_, err := sendTx(t, answer, round, s.key, instance, client, func(receipt *types.Receipt, err error) {
+		if retry != nil && lostRace(err) {
+			// Stay pending until the retry has begun its own transmission,
+			// so the next tick cannot send the round a second time.
+			go func() {
+				defer t.settled()
+				retry()
+			}()
+			return
+		}
+		defer t.settled()
+		if batch != nil {
+			batch.record(s.address, err)
+		}
+		f.countOutcome(t, err)
+		if err != nil {
+			f.transmitFailed(t, s.address, round, answer, err, batch != nil, true)
+			return
+		}
+		log.Info("Transmission mined", "feed", f.name, "target", t, "round", round, "signer", s.address, "hash", receipt.TxHash, "block", receipt.BlockNumber)
+	})
+	if err != nil {
+		defer t.settled()
+		if retry != nil && lostRace(err) {
+			retry()
+			return
+		}
+		if batch != nil {
+			batch.record(s.address, err)
+		}
+		f.countOutcome(t, err)
+		if errors.As(err, new(*revertError)) {
+			f.transmitFailed(t, s.address, round, answer, err, batch != nil, false)
+		}
+	}
+}
+
+// countOutcome tracks consecutive failed transmissions to t and raises
+// failed_transmits once they reach the rule threshold. Losing a round race
+// is not a failure.
+func (f *feed) countOutcome(t *aggregatorTarget, err error) {
+	switch {
+	case err == nil:
+		if t.transmitOK() > 0 {
+			resolveAlert(alertFailedTransmits, f.name, "target", t)
+		}
+	case lostRace(err):
+	default:
+		n := t.transmitFailure()
+		if threshold, ok := alertThreshold(alertFailedTransmits, f.name); ok && float64(n) >= threshold {
+			raiseAlert(alertFailedTransmits, f.name, "Consecutive transmissions failed", "target", t, "failures", n, "err", err)
+		}
+	}
+}
+
+// dryRunTransmit simulates the transmission and logs the call that would
+// have been made instead of signing it. The first usable loaded key is the
+// sender; without one, the first aggregator signer is, so feeds can be tried
+// before their keys exist.
+func (f *feed) dryRunTransmit(t *aggregatorTarget, client *czzclient.Client, candidates []*signer, round uint32, answer *big.Int) {
+	var from common.Address
+	if len(candidates) > 0 {
+		from = candidates[0].address
+	} else if signer, ok := t.signers.first(); ok {
+		from = signer
+	} else {
+		log.Warn("Dry run: aggregator signers unknown and no usable key, not simulating", "feed", f.name, "target", t, "call", fmt.Sprintf("Transmit(%d, %v)", round, answer))
+		return
+	}
+	gas, err := simulateTransmit(context.TODO(), t, client, from, round, answer)
+	if err != nil {
+		log.Warn("Dry run: transmit simulation failed", "feed", f.name, "target", t, "from", from, "call", fmt.Sprintf("Transmit(%d, %v)", round, answer), "err", err)
+		return
+	}
+	log.Info("Dry run: would transmit", "feed", f.name, "target", t, "from", from, "call", fmt.Sprintf("Transmit(%d, %v)", round, answer), "gas", gas)
+}
+
+// transmitFailed reacts to a transmission that was not mined successfully.
+// Losing the race for a round is expected when several signers transmit it.
+// mined is false for a revert seen in simulation, where nothing was
+// broadcast; only a reverted receipt raises tx_reverted.
+func (f *feed) transmitFailed(t *aggregatorTarget, signer common.Address, round uint32, answer *big.Int, err error, batched, mined bool) {
+	switch {
+	case lostRace(err) && batched:
+		log.Debug("Round filled by another signer", "feed", f.name, "target", t, "round", round, "signer", signer, "err", err)
+	case lostRace(err):
+		// Not retried; the next tick reads the new round.
+		log.Info("Round already advanced", "feed", f.name, "target", t, "round", round, "signer", signer, "err", err)
+	case errors.Is(err, errSignerNotExist):
+		t.disableSigner(signer)
+		raiseAlert(alertSignerDisabled, f.name, "Signer not authorized by aggregator", "target", t, "signer", signer)
+	case errors.Is(err, errAnswerOutOfRange):
+		raiseAlert(alertOutOfRange, f.name, "Aggregator rejected answer as out of range",
+			"target", t, "round", round, "answer", answer, "min", t.minAnswer, "max", t.maxAnswer)
+	case errors.As(err, new(*revertError)) && !mined:
+		// Counted by sendTx as a simulation revert.
+	case errors.As(err, new(*revertError)):
+		raiseAlert(alertTxReverted, f.name, "Transmission reverted", "target", t, "round", round, "signer", signer, "err", err)
+	default:
+		log.Error("Transmission failed", "feed", f.name, "target", t, "round", round, "signer", signer, "err", err)
+	}
+}
+
+// checkRange applies the out of range policy of the feed to answer. It
+// returns the answer to transmit, or false if nothing should be sent.
+func (f *feed) checkRange(t *aggregatorTarget, answer *big.Int) (*big.Int, bool) {
+	if t.inRange(answer) {
+		return answer, true
+	}
+	raiseAlert(alertOutOfRange, f.name, "Answer outside aggregator range",
+		"target", t, "answer", answer, "min", t.minAnswer, "max", t.maxAnswer, "policy", f.coin.OutOfRange)
+
+	switch f.coin.OutOfRange {
+	case outOfRangeClamp:
+		return t.clamp(answer), true
+	case outOfRangePause:
+		t.pause()
+		log.Warn("Target paused until restart", "feed", f.name, "target", t)
+	}
+	return nil, false
+}
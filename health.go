@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// defaultReadyGrace is how long past its heartbeat an aggregator may go
+// without an update before the daemon reports itself not ready.
+const defaultReadyGrace = 5 * time.Minute
+
+// healthCheck is the outcome of one check in a /healthz or /readyz body.
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"` // "ok" or "failing"
+	Checks []healthCheck `json:"checks"`
+}
+
+// healthChecker answers the liveness and readiness probes.
+type healthChecker struct {
+	chains  map[string]*evmChain
+	signers []*signer
+	grace   time.Duration
+}
+
+func newHealthChecker(chains map[string]*evmChain, signers []*signer, grace time.Duration) *healthChecker {
+	return &healthChecker{chains: chains, signers: signers, grace: grace}
+}
+
+func (h *healthChecker) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.serveHealthz)
+	mux.HandleFunc("/readyz", h.serveReadyz)
+}
+
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	report := healthReport{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			report.Status, code = "failing", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, report)
+}
+
+func check(name string, err error) healthCheck {
+	if err != nil {
+		return healthCheck{Name: name, Error: err.Error()}
+	}
+	return healthCheck{Name: name, OK: true}
+}
+
+// serveHealthz reports whether the process is up with its configuration
+// loaded and keys decrypted.
+func (h *healthChecker) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	checks := []healthCheck{check("config", nil)}
+	var err error
+	if len(h.signers) == 0 && !dryRun {
+		err = fmt.Errorf("no signing key loaded")
+	}
+	checks = append(checks, check("keys", err))
+	writeHealth(w, checks)
+}
+
+// serveReadyz fails when a chain has no healthy RPC endpoint, an aggregator
+// is not loaded yet or missed its heartbeat by more than the grace period, or
+// a signer balance is below the min_balance of its chain.
+func (h *healthChecker) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	var checks []healthCheck
+
+	names := make([]string, 0, len(h.chains))
+	for name := range h.chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		chain := h.chains[name]
+		_, err := chain.pool.Client()
+		checks = append(checks, check("rpc/"+name, err))
+		if chain.minBalance == nil {
+			continue
+		}
+		for _, s := range h.signers {
+			var err error
+			if balance := balances.get(name, s.address); balance != nil && balance.Cmp(chain.minBalance) < 0 {
+				err = fmt.Errorf("balance %v below min_balance %v", weiToEther(balance), weiToEther(chain.minBalance))
+			}
+			checks = append(checks, check("balance/"+name+"/"+s.address.Hex(), err))
+		}
+	}
+
+	feedNames := make([]string, 0, len(feeds))
+	for name := range feeds {
+		feedNames = append(feedNames, name)
+	}
+	sort.Strings(feedNames)
+	for _, name := range feedNames {
+		f := feeds[name]
+		for _, t := range f.targets {
+			err := f.checkStale(t, h.grace)
+			if !t.isLoaded() {
+				err = fmt.Errorf("aggregator not loaded yet")
+			}
+			checks = append(checks, check("feed/"+name+"/"+t.String(), err))
+		}
+	}
+	writeHealth(w, checks)
+}
+
+// checkStale fails when the last known on-chain update of t is older than the
+// heartbeat of f plus grace.
+func (f *feed) checkStale(t *aggregatorTarget, grace time.Duration) error {
+	t.state.mu.RLock()
+	data := t.state.data
+	t.state.mu.RUnlock()
+	if data.Answer == nil {
+		return fmt.Errorf("on-chain round not read yet")
+	}
+	if age := time.Since(data.UpdatedAt); age > f.policy.heartbeat+grace {
+		return fmt.Errorf("round %d updated %v ago, heartbeat %v", data.Round, age.Round(time.Second), f.policy.heartbeat)
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/core/types"
+	"github.com/classzz/go-classzz-v2/czzdb"
+	"github.com/classzz/go-classzz-v2/czzdb/leveldb"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+const (
+	defaultRetention   = 30 * 24 * time.Hour
+	historyPruneEvery  = time.Hour
+	historyCacheMB     = 16
+	historyFileHandles = 16
+)
+
+// Record kinds, the first byte of every history key.
+const (
+	kindObservation  byte = 'o'
+	kindAggregate    byte = 'a'
+	kindDecision     byte = 'd'
+	kindTransmission byte = 't'
+	kindTxIndex      byte = 'h' // transaction hash -> transmission key
+)
+
+// Transmission statuses.
+const (
+	txPending  = "pending"
+	txMined    = "mined"
+	txReverted = "reverted"
+	txFailed   = "failed"
+)
+
+// txStatus returns the status of a transmission settled with err.
+func txStatus(err error) string {
+	switch {
+	case err == nil:
+		return txMined
+	case errors.As(err, new(*revertError)):
+		return txReverted
+	}
+	return txFailed
+}
+
+// history is the store of this node, nil when disabled.
+var history *historyStore
+
+// ObservationRecord is the price one source returned for a feed.
+type ObservationRecord struct {
+	Feed     string    `json:"feed"`
+	Source   string    `json:"source"`
+	Price    string    `json:"price"`
+	Rejected bool      `json:"rejected,omitempty"` // dropped as an outlier
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// AggregateRecord is the aggregated price of a feed for one tick.
+type AggregateRecord struct {
+	Feed     string    `json:"feed"`
+	Median   string    `json:"median,omitempty"`
+	Accepted int       `json:"accepted"`
+	Rejected int       `json:"rejected"`
+	Errors   int       `json:"errors"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// DecisionRecord is the update policy outcome for one target.
+type DecisionRecord struct {
+	Feed          string    `json:"feed"`
+	Target        string    `json:"target"`
+	Round         uint32    `json:"round"` // latest on-chain round
+	Answer        string    `json:"answer"`
+	OnchainAnswer string    `json:"onchain_answer"`
+	Submit        bool      `json:"submit"`
+	Reason        string    `json:"reason"`
+	DeviationBps  float64   `json:"deviation_bps"`
+	Age           string    `json:"age"`
+	Time          time.Time `json:"time"`
+}
+
+// TransmissionRecord is one broadcast Transmit transaction and its outcome.
+type TransmissionRecord struct {
+	Feed      string         `json:"feed"`
+	Target    string         `json:"target"`
+	Round     uint32         `json:"round"`
+	Answer    string         `json:"answer"`
+	From      common.Address `json:"from"`
+	Hash      common.Hash    `json:"hash"`
+	Nonce     uint64         `json:"nonce"`
+	Gas       uint64         `json:"gas"`
+	GasPrice  string         `json:"gas_price,omitempty"`
+	GasFeeCap string         `json:"gas_fee_cap,omitempty"`
+	GasTipCap string         `json:"gas_tip_cap,omitempty"`
+	Status    string         `json:"status"`
+	Error     string         `json:"error,omitempty"`
+	MinedHash *common.Hash   `json:"mined_hash,omitempty"` // differs from Hash after a fee bump
+	Block     uint64         `json:"block,omitempty"`
+	GasUsed   uint64         `json:"gas_used,omitempty"`
+	Time      time.Time      `json:"time"`
+	Updated   time.Time      `json:"updated"`
+}
+
+// historyQuery selects records of one feed in [From, To], newest first.
+// A zero From or To leaves that end open; Limit 0 returns every record.
+type historyQuery struct {
+	Feed   string
+	From   time.Time
+	To     time.Time
+	Offset int
+	Limit  int
+}
+
+// historyStore records what the daemon fetched, decided and sent in an
+// embedded LevelDB. Keys are kind | feed | 0 | ^unix nanos | ^sequence: the
+// bits are inverted so the forward-only iterators of LevelDB return the
+// records of a feed newest first.
+type historyStore struct {
+	db        czzdb.KeyValueStore
+	retention time.Duration
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+func openHistory(c config.History) (*historyStore, error) {
+	retention, err := config.ParseDuration(c.Retention, defaultRetention)
+	if err != nil {
+		return nil, err
+	}
+	db, err := leveldb.New(c.Path, historyCacheMB, historyFileHandles, "oracle/history/", false)
+	if err != nil {
+		return nil, err
+	}
+	h := &historyStore{db: db, retention: retention}
+	go h.pruneLoop()
+	return h, nil
+}
+
+func historyPrefix(kind byte, feed string) []byte {
+	key := make([]byte, 0, len(feed)+2)
+	key = append(key, kind)
+	key = append(key, feed...)
+	return append(key, 0)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func (h *historyStore) key(kind byte, feed string, at time.Time) []byte {
+	h.mu.Lock()
+	h.seq++
+	seq := h.seq
+	h.mu.Unlock()
+	key := historyPrefix(kind, feed)
+	key = appendUint64(key, ^uint64(at.UnixNano()))
+	return appendUint64(key, ^seq)
+}
+
+// keyTime returns the unix nanos of a record key, or false for a key of
+// another layout.
+func keyTime(key []byte) (int64, bool) {
+	sep := len(key) - 17 // 0 | ^nanos | ^sequence
+	if sep < 1 || key[sep] != 0 {
+		return 0, false
+	}
+	return int64(^binary.BigEndian.Uint64(key[sep+1:])), true
+}
+
+func (h *historyStore) put(key []byte, record interface{}) {
+	value, err := json.Marshal(record)
+	if err == nil {
+		err = h.db.Put(key, value)
+	}
+	if err != nil {
+		log.Warn("Failed to write history", "err", err)
+	}
+}
+
+// recordAggregate stores the observations and the outcome of one tick.
+func (h *historyStore) recordAggregate(feed string, report *aggregateReport, aggErr error) {
+	if h == nil {
+		return
+	}
+	now := time.Now()
+	agg := &AggregateRecord{Feed: feed, Errors: len(report.Errors), Time: now}
+	for _, o := range report.Accepted {
+		h.put(h.key(kindObservation, feed, now), &ObservationRecord{Feed: feed, Source: o.Source, Price: o.Price.FloatString(18), Time: o.Timestamp})
+		agg.Accepted++
+	}
+	for _, o := range report.Rejected {
+		h.put(h.key(kindObservation, feed, now), &ObservationRecord{Feed: feed, Source: o.Source, Price: o.Price.FloatString(18), Rejected: true, Time: o.Timestamp})
+		agg.Rejected++
+	}
+	for id, err := range report.Errors {
+		h.put(h.key(kindObservation, feed, now), &ObservationRecord{Feed: feed, Source: id, Error: err.Error(), Time: now})
+	}
+	if report.Median != nil {
+		agg.Median = report.Median.FloatString(18)
+	}
+	if aggErr != nil {
+		agg.Error = aggErr.Error()
+	}
+	h.put(h.key(kindAggregate, feed, now), agg)
+}
+
+// recordDecision stores the update policy outcome for t.
+func (h *historyStore) recordDecision(feed string, t *aggregatorTarget, latest roundData, answer *big.Int, d updateDecision) {
+	if h == nil {
+		return
+	}
+	now := time.Now()
+	h.put(h.key(kindDecision, feed, now), &DecisionRecord{
+		Feed:          feed,
+		Target:        t.String(),
+		Round:         latest.Round,
+		Answer:        answer.String(),
+		OnchainAnswer: latest.Answer.String(),
+		Submit:        d.Submit,
+		Reason:        d.Reason,
+		DeviationBps:  d.DeviationBps,
+		Age:           d.Age.Round(time.Second).String(),
+		Time:          now,
+	})
+}
+
+// recordTransmission stores a broadcast transmission as pending.
+func (h *historyStore) recordTransmission(feed string, t *aggregatorTarget, round uint32, answer *big.Int, from common.Address, tx *types.Transaction) {
+	if h == nil {
+		return
+	}
+	now := time.Now()
+	rec := &TransmissionRecord{
+		Feed:    feed,
+		Target:  t.String(),
+		Round:   round,
+		Answer:  answer.String(),
+		From:    from,
+		Hash:    tx.Hash(),
+		Nonce:   tx.Nonce(),
+		Gas:     tx.Gas(),
+		Status:  txPending,
+		Time:    now,
+		Updated: now,
+	}
+	if tx.Type() == types.DynamicFeeTxType {
+		rec.GasFeeCap, rec.GasTipCap = tx.GasFeeCap().String(), tx.GasTipCap().String()
+	} else {
+		rec.GasPrice = tx.GasPrice().String()
+	}
+	key := h.key(kindTransmission, feed, now)
+	h.put(key, rec)
+	if err := h.db.Put(append([]byte{kindTxIndex}, rec.Hash[:]...), key); err != nil {
+		log.Warn("Failed to write history", "err", err)
+	}
+}
+
+// settleTransmission stores the outcome of the transmission sent as hash.
+func (h *historyStore) settleTransmission(hash common.Hash, receipt *types.Receipt, err error) {
+	if h == nil {
+		return
+	}
+	key, dbErr := h.db.Get(append([]byte{kindTxIndex}, hash[:]...))
+	if dbErr != nil {
+		return
+	}
+	value, dbErr := h.db.Get(key)
+	if dbErr != nil {
+		return
+	}
+	var rec TransmissionRecord
+	if json.Unmarshal(value, &rec) != nil {
+		return
+	}
+	rec.Status = txStatus(err)
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if receipt != nil {
+		mined := receipt.TxHash
+		rec.MinedHash, rec.Block, rec.GasUsed = &mined, receipt.BlockNumber.Uint64(), receipt.GasUsed
+	}
+	rec.Updated = time.Now()
+	h.put(key, &rec)
+}
+
+// query calls fn with the raw records of kind matching q, newest first. It
+// seeks to the upper bound of q and reads no more than Offset+Limit records.
+func (h *historyStore) query(kind byte, q historyQuery, fn func([]byte) error) error {
+	prefix := historyPrefix(kind, q.Feed)
+	var start []byte
+	if !q.To.IsZero() {
+		start = appendUint64(nil, ^uint64(q.To.UnixNano()))
+	}
+	it := h.db.NewIterator(prefix, start)
+	defer it.Release()
+
+	skipped, sent := 0, 0
+	for it.Next() {
+		if q.Limit > 0 && sent >= q.Limit {
+			break
+		}
+		at, ok := keyTime(it.Key())
+		if !ok || len(it.Key()) != len(prefix)+16 {
+			continue
+		}
+		if !q.From.IsZero() && at < q.From.UnixNano() {
+			break
+		}
+		if skipped < q.Offset {
+			skipped++
+			continue
+		}
+		if err := fn(common.CopyBytes(it.Value())); err != nil {
+			return err
+		}
+		sent++
+	}
+	return it.Error()
+}
+
+// Observations returns the source observations of a feed.
+func (h *historyStore) Observations(q historyQuery) ([]*ObservationRecord, error) {
+	var res []*ObservationRecord
+	err := h.query(kindObservation, q, func(v []byte) error {
+		r := new(ObservationRecord)
+		res = append(res, r)
+		return json.Unmarshal(v, r)
+	})
+	return res, err
+}
+
+// Aggregates returns the aggregated prices of a feed.
+func (h *historyStore) Aggregates(q historyQuery) ([]*AggregateRecord, error) {
+	var res []*AggregateRecord
+	err := h.query(kindAggregate, q, func(v []byte) error {
+		r := new(AggregateRecord)
+		res = append(res, r)
+		return json.Unmarshal(v, r)
+	})
+	return res, err
+}
+
+// Decisions returns the update policy outcomes of a feed.
+func (h *historyStore) Decisions(q historyQuery) ([]*DecisionRecord, error) {
+	var res []*DecisionRecord
+	err := h.query(kindDecision, q, func(v []byte) error {
+		r := new(DecisionRecord)
+		res = append(res, r)
+		return json.Unmarshal(v, r)
+	})
+	return res, err
+}
+
+// Transmissions returns the transmissions sent for a feed.
+func (h *historyStore) Transmissions(q historyQuery) ([]*TransmissionRecord, error) {
+	var res []*TransmissionRecord
+	err := h.query(kindTransmission, q, func(v []byte) error {
+		r := new(TransmissionRecord)
+		res = append(res, r)
+		return json.Unmarshal(v, r)
+	})
+	return res, err
+}
+
+// pruneLoop deletes records older than the retention period.
+func (h *historyStore) pruneLoop() {
+	for {
+		if n, err := h.prune(time.Now().Add(-h.retention)); err != nil {
+			log.Warn("Failed to prune history", "err", err)
+		} else if n > 0 {
+			log.Info("Pruned history", "records", n, "retention", h.retention)
+		}
+		time.Sleep(historyPruneEvery)
+	}
+}
+
+func (h *historyStore) prune(cutoff time.Time) (int, error) {
+	batch := h.db.NewBatch()
+	n := 0
+	for _, kind := range []byte{kindObservation, kindAggregate, kindDecision, kindTransmission} {
+		it := h.db.NewIterator([]byte{kind}, nil)
+		for it.Next() {
+			key := it.Key()
+			if at, ok := keyTime(key); !ok || at >= cutoff.UnixNano() {
+				continue
+			}
+			batch.Delete(common.CopyBytes(key))
+			if kind == kindTransmission {
+				var rec TransmissionRecord
+				if json.Unmarshal(it.Value(), &rec) == nil {
+					batch.Delete(append([]byte{kindTxIndex}, rec.Hash[:]...))
+				}
+			}
+			n++
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return n, err
+		}
+	}
+	return n, batch.Write()
+}
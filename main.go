@@ -3,314 +3,216 @@ package main
 import (
 	"context"
 	"crypto/ecdsa"
-	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"math/big"
-	"math/rand"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/classzz/classzz-orace/config"
 	"github.com/classzz/go-classzz-v2/accounts/abi/bind"
 	"github.com/classzz/go-classzz-v2/accounts/keystore"
-	"github.com/classzz/go-classzz-v2/common"
 	"github.com/classzz/go-classzz-v2/console/prompt"
 	"github.com/classzz/go-classzz-v2/core/types"
 	"github.com/classzz/go-classzz-v2/crypto"
 	"github.com/classzz/go-classzz-v2/czzclient"
 	"github.com/classzz/go-classzz-v2/log"
+	"github.com/classzz/go-classzz-v2/metrics"
 )
 
-type Candlestick struct {
-	QuoteVolume   string `json:"quoteVolume"`
-	BaseVolume    string `json:"baseVolume"`
-	HighestBid    string `json:"highestBid"`
-	High24Hr      string `json:"high24hr"`
-	Last          string `json:"last"`
-	LowestAsk     string `json:"lowestAsk"`
-	Elapsed       string `json:"elapsed"`
-	Result        string `json:"result"`
-	Low24Hr       string `json:"low24hr"`
-	PercentChange string `json:"percentChange"`
-}
-
-type Ave struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
-	Data struct {
-		CirculatingSupply string      `json:"circulating_supply"`
-		MarketCap         string      `json:"market_cap"`
-		High24H           string      `json:"high_24h"`
-		Low24H            string      `json:"low_24h"`
-		Volume24H         string      `json:"volume_24h"`
-		TxCount24H        string      `json:"tx_count_24h"`
-		Amount24H         string      `json:"amount_24h"`
-		Turnover24H       string      `json:"turnover_24h"`
-		TotalSupply       string      `json:"total_supply"`
-		Price             string      `json:"price"`
-		Token             string      `json:"token"`
-		Chain             string      `json:"chain"`
-		Symbol            string      `json:"symbol"`
-		Decimal           int         `json:"decimal"`
-		Name              string      `json:"name"`
-		Holders           int         `json:"holders"`
-		IntroCn           string      `json:"intro_cn"`
-		IntroEn           string      `json:"intro_en"`
-		PriceChange       string      `json:"price_change"`
-		LogoUrl           interface{} `json:"logo_url"`
-		RiskLevel         int         `json:"risk_level"`
-		RiskInfo          interface{} `json:"risk_info"`
-		Appendix          string      `json:"appendix"`
-	} `json:"data"`
-}
-
 var (
 	cfg           config.Config
 	startInterval = 1 * time.Minute
+	dryRun        bool
+	testAlert     bool
 )
 
 func main() {
 
+	flag.BoolVar(&dryRun, "dry-run", false, "fetch, aggregate and simulate transmissions without signing or broadcasting")
+	flag.BoolVar(&testAlert, "test-alert", false, "send a test alert to every configured webhook and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--dry-run] [--test-alert] [config.json]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	metrics.Enabled = true
+
 	// Load configuration file
-	config.LoadConfig(&cfg, "")
+	config.LoadConfig(&cfg, flag.Arg(0))
 	glogger := log.NewGlogHandler(log.StreamHandler(os.Stderr, log.TerminalFormat(true)))
 	glogger.Verbosity(log.Lvl(cfg.DebugLevel))
 	log.Root().SetHandler(glogger)
-	privateKeys := loadSigningKey(cfg.PrivatePath, "")
-	for _, v := range cfg.Coins {
-		if v.Type == 1 {
-			go send(v, privateKeys)
-		} else if v.Type == 2 {
-			go sendFren(v, privateKeys)
-		}
-	}
-	select {}
-}
-
-func send(coin config.Coins, privateKeys []*ecdsa.PrivateKey) {
-
-	startTicker := time.NewTicker(startInterval)
-	for {
-		select {
-		case <-startTicker.C:
-
-			resp, err := http.Get(coin.Url)
-			if err != nil {
-				log.Error("send", "http get", err)
-				continue
-			}
-			defer resp.Body.Close()
-			body, _ := ioutil.ReadAll(resp.Body)
-			var res Candlestick
-			_ = json.Unmarshal(body, &res)
-
-			//sendCzz(privateKeys, res, common.HexToAddress(coin.CzzAddress), hourcount)
-			sendEthf(privateKeys, res, common.HexToAddress(coin.EthfAddress))
-		}
-	}
-}
-
-func sendFren(coin config.Coins, privateKeys []*ecdsa.PrivateKey) {
-
-	startTicker := time.NewTicker(startInterval)
-	for {
-		select {
-		case <-startTicker.C:
-			req, err := http.NewRequest("GET", coin.Url, nil)
-			req.Header.Add("Ave-Auth", "0x2w3d7af564e4bfda1c483642db7200787135ffet")
-			client := http.Client{
-				Timeout: 30 * time.Second,
-			}
-			resp, err := client.Do(req)
-
-			if err != nil {
-				log.Error("send", "http get", err)
-				continue
-			}
-			defer resp.Body.Close()
-			body, _ := ioutil.ReadAll(resp.Body)
-			var res Ave
-			_ = json.Unmarshal(body, &res)
 
-			sendEthfAve(privateKeys, res, common.HexToAddress(coin.EthfAddress))
-		}
-	}
-}
-
-//func sendCzz(privateKeys map[common.Address]*ecdsa.PrivateKey, res Candlestick, cAddress common.Address, hourcount int) {
-//
-//	czzClient, err := czzclient.Dial("https://node.classzz.com")
-//	if err != nil {
-//		log.Error("NewClient", "err", err)
-//	}
-//
-//	instance, err := NewAggregator(cAddress, czzClient)
-//	latestRoundData, err := instance.LatestRoundData(nil)
-//	if err != nil || latestRoundData.Answer == nil {
-//		return
-//	}
-//	index := 2
-//	datas := res.Data[len(res.Data)-1]
-//	for _, v := range privateKeys {
-//		log.Info("sendCzz", "latestRound", latestRoundData.RoundId, "index", index)
-//		rate, _ := big.NewFloat(0.0).SetString(datas[index])
-//		rateInt, _ := big.NewFloat(0).Mul(rate, big.NewFloat(100000000)).Int(nil)
-//
-//		a := big.NewInt(0).Sub(rateInt, latestRoundData.Answer)
-//		b := a.Abs(a)
-//		c := b.Mul(b, big.NewInt(20))
-//		if c.Cmp(rateInt) <= 0 && hourcount < 60 {
-//			return
-//		}
-//		hourcount = 0
-//		sendTx(rateInt, uint32(latestRoundData.RoundId.Uint64())+1, v, instance, czzClient)
-//		index++
-//	}
-//}
-
-func sendEthfAve(privateKeys []*ecdsa.PrivateKey, res Ave, cAddress common.Address) {
-
-	czzClient, err := czzclient.Dial("https://rpc.etherfair.org")
+	alertManager, err := newAlertManager(cfg.Alerting)
 	if err != nil {
-		log.Error("NewClient", "err", err)
+		log.Error("newAlertManager", "err", err)
+		os.Exit(1)
 	}
-
-	instance, err := NewAggregator(cAddress, czzClient)
-	latestRoundData, err := instance.LatestRoundData(nil)
-	if err != nil || latestRoundData.Answer == nil {
+	if testAlert {
+		if err := alertManager.testAlerts(); err != nil {
+			log.Error("Test alert", "err", err)
+			os.Exit(1)
+		}
 		return
 	}
-
-	rand.Seed(time.Now().UnixNano())
-	num := rand.Intn(3)
-
-	privateKey := privateKeys[num]
-
-	log.Info("sendEthf", "latestRound", latestRoundData.RoundId, "cAddress", cAddress.String())
-
-	rate, _ := big.NewFloat(0.0).SetString(res.Data.Price)
-	if rate == nil {
-		log.Error("NewClient", "rate", "rate is null")
-		return
+	alerts = alertManager
+	grace, err := config.ParseDuration(cfg.ReadyGrace, defaultReadyGrace)
+	if err != nil {
+		log.Error("ready_grace", "err", err)
+		os.Exit(1)
 	}
-	rateInt, _ := big.NewFloat(0).Mul(rate, big.NewFloat(100000000)).Int(nil)
-	a := big.NewInt(0).Sub(rateInt, latestRoundData.Answer)
-	b := a.Abs(a)
-	c := b.Mul(b, big.NewInt(20))
 
-	diff := MinutesDiffFromTimestamp(latestRoundData.StartedAt.Int64())
-	if c.Cmp(rateInt) <= 0 && diff < 60 {
-		return
+	var privateKeys []*ecdsa.PrivateKey
+	if dryRun {
+		log.Warn("Dry run: transactions are simulated, never signed or broadcast")
 	}
-	sendTx(rateInt, uint32(latestRoundData.RoundId.Uint64())+1, privateKey, instance, czzClient)
-}
-
-func sendEthf(privateKeys []*ecdsa.PrivateKey, res Candlestick, cAddress common.Address) {
-
-	czzClient, err := czzclient.Dial("https://rpc.etherfair.org")
-	if err != nil {
-		log.Error("NewClient", "err", err)
+	if !dryRun || len(cfg.PrivatePath) > 0 {
+		privateKeys = loadSigningKey(cfg.PrivatePath, "")
 	}
-
-	instance, err := NewAggregator(cAddress, czzClient)
-	latestRoundData, err := instance.LatestRoundData(nil)
-	if err != nil || latestRoundData.Answer == nil {
-		return
+	if cfg.History.Path != "" {
+		store, err := openHistory(cfg.History)
+		if err != nil {
+			log.Error("openHistory", "path", cfg.History.Path, "err", err)
+			os.Exit(1)
+		}
+		history = store
 	}
-
-	rand.Seed(time.Now().UnixNano())
-	num := rand.Intn(3)
-
-	privateKey := privateKeys[num]
-
-	log.Info("sendEthf", "latestRound", latestRoundData.RoundId, "cAddress", cAddress.String())
-
-	rate, _ := big.NewFloat(0.0).SetString(res.Last)
-	if rate == nil {
-		log.Error("NewClient", "rate", "rate is null")
-		return
+	chains := make(map[string]*evmChain)
+	for _, c := range cfg.Chains {
+		chain, err := newEvmChain(c)
+		if err != nil {
+			log.Error("newEvmChain", "chain", c.Name, "err", err)
+			os.Exit(1)
+		}
+		chains[c.Name] = chain
+	}
+	signers := newSigners(privateKeys)
+	if cfg.Consensus.Enabled && dryRun {
+		// A dry run never transmits, so it must not observe, approve or
+		// lead rounds of the live members.
+		log.Warn("Dry run: consensus disabled")
+	} else if cfg.Consensus.Enabled {
+		node, err := newConsensusNode(cfg.Consensus, signers)
+		if err != nil {
+			log.Error("newConsensusNode", "err", err)
+			os.Exit(1)
+		}
+		consensus = node
+		go consensus.listen(cfg.Consensus.Listen)
 	}
-	rateInt, _ := big.NewFloat(0).Mul(rate, big.NewFloat(100000000)).Int(nil)
-	a := big.NewInt(0).Sub(rateInt, latestRoundData.Answer)
-	b := a.Abs(a)
-	c := b.Mul(b, big.NewInt(20))
-
-	diff := MinutesDiffFromTimestamp(latestRoundData.StartedAt.Int64())
-	if c.Cmp(rateInt) <= 0 && diff < 60 {
-		return
+	for _, v := range cfg.Coins {
+		f, err := newFeed(v, chains)
+		if err != nil {
+			log.Error("newFeed", "feed", v.FeedName(), "err", err)
+			os.Exit(1)
+		}
+		feeds[f.name] = f
+		go f.run(signers)
+	}
+	if len(signers) > 0 {
+		go watchBalances(chains, signers)
+	}
+	go watchStaleness(grace)
+	if cfg.HttpAddr != "" {
+		health := newHealthChecker(chains, signers, grace)
+		mux := newAPIHandler()
+		mux.Handle("/metrics", metricsHandler())
+		health.register(mux)
+		go serveAPI(cfg.HttpAddr, mux)
+	}
+
+	// SIGUSR1 dumps the nonce and transaction manager state for debugging.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	for range sigs {
+		for _, s := range nonces.snapshot() {
+			log.Info("Nonce state", "chain", s.Chain, "address", s.Address, "next", s.Next, "synced", s.Synced, "synced_at", s.SyncedAt, "inflight", s.Inflight)
+		}
+		for _, s := range txs.snapshot() {
+			log.Info("Tracked transaction", "chain", s.Chain, "from", s.From, "nonce", s.Nonce, "hashes", s.Hashes, "bumps", s.Bumps, "cancel", s.Cancel)
+		}
 	}
-	sendTx(rateInt, uint32(latestRoundData.RoundId.Uint64())+1, privateKey, instance, czzClient)
 }
 
-func sendTx(rate *big.Int, latestRound uint32, privateKey *ecdsa.PrivateKey, aggregator *Aggregator, client *czzclient.Client) {
+// sendTx simulates a transmission of rate for latestRound to t, broadcasts it
+// and hands it to the transaction manager, which calls done once it is
+// settled. A reverting simulation is returned as a revertError and nothing is
+// broadcast.
+func sendTx(t *aggregatorTarget, rate *big.Int, latestRound uint32, privateKey *ecdsa.PrivateKey, aggregator *Aggregator, client *czzclient.Client, done func(*types.Receipt, error)) (*types.Transaction, error) {
 
-	publicKey := privateKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		log.Error("error casting public key to ECDSA")
-		return
-	}
+	fromAddress := crypto.PubkeyToAddress(privateKey.PublicKey)
 
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
-	nonce, err := client.PendingNonceAt(context.TODO(), fromAddress)
+	gasLimit, err := simulateTransmit(context.TODO(), t, client, fromAddress, latestRound, rate)
 	if err != nil {
-		log.Error("PendingNonceAt", "err", err)
-		return
+		if rerr, ok := err.(*revertError); ok {
+			countRevert("simulation", rerr)
+			log.Warn("Transmit simulation reverted", "target", t, "round", latestRound, "answer", rate, "from", fromAddress, "reason", rerr.Reason)
+		}
+		return nil, err
 	}
 
-	gasPrice, err := client.SuggestGasPrice(context.TODO())
+	fees, err := t.chain.suggestFees(context.TODO(), client)
 	if err != nil {
-		log.Error("SuggestGasPrice", "err", err)
-		return
+		log.Error("SuggestGasPrice", "target", t, "err", err)
+		return nil, err
 	}
 
-	chainId, err := client.ChainID(context.TODO())
+	lease, err := nonces.acquire(context.TODO(), t.chain.name, client, fromAddress)
 	if err != nil {
-		log.Error("SuggestGasPrice", "err", err)
-		return
+		log.Error("PendingNonceAt", "err", err)
+		return nil, err
 	}
 
-	auth, _ := bind.NewKeyedTransactorWithChainID(privateKey, chainId)
-	auth.Nonce = big.NewInt(int64(nonce))
+	auth, _ := bind.NewKeyedTransactorWithChainID(privateKey, t.chain.id)
+	auth.Nonce = new(big.Int).SetUint64(lease.Nonce)
 	auth.Value = big.NewInt(0) // in wei
-	auth.GasPrice = gasPrice   // in wei
-
-	tx, err := aggregator.Transmit(auth, latestRound, rate)
-	if err != nil {
-		log.Error("Transmit", "err", err)
-		return
+	auth.GasLimit = gasLimit
+	if fees.dynamic() {
+		auth.GasFeeCap = fees.FeeCap // in wei
+		auth.GasTipCap = fees.TipCap // in wei
 	} else {
-		log.Info("tx", "hash", tx.Hash())
+		auth.GasPrice = fees.GasPrice // in wei
 	}
-	check(tx, client)
-}
-
-func check(checkTx *types.Transaction, client *czzclient.Client) {
-	count := 0
-	for {
-		count++
-		receipt, err := client.TransactionReceipt(context.TODO(), checkTx.Hash())
-
-		if receipt == nil {
-
-			if err != nil {
-				log.Error("TransactionReceipt", "err", err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
 
-			log.Error("TransactionReceipt", "Receipt", receipt)
-			time.Sleep(5 * time.Second)
-			if count >= 10 {
-				log.Warn("Please command query later.", "txHash", checkTx.Hash().String())
-			}
-			continue
+	auth.NoSend = true // sent below, so a transaction the node already has counts as broadcast
+	tx, err := aggregator.Transmit(auth, latestRound, rate)
+	if err == nil {
+		if err = client.SendTransaction(context.TODO(), tx); isKnownTx(err) {
+			log.Debug("Transaction already known to the node", "target", t, "hash", tx.Hash(), "nonce", tx.Nonce())
+			err = nil
 		}
-
-		log.Info("Please success ", "txHash", checkTx.Hash().String())
-		break
 	}
+	if err != nil {
+		lease.release(err)
+		log.Error("Transmit", "target", t, "nonce", lease.Nonce, "err", err)
+		return nil, err
+	}
+	lease.commit(tx.Hash())
+	log.Info("tx", "target", t, "hash", tx.Hash(), "nonce", tx.Nonce())
+
+	t.sent(latestRound, tx.Hash())
+	balances.setTxCost(t.chain.name, tx.Cost())
+	countSent(t.feed)
+	sentAt := time.Now()
+	history.recordTransmission(t.feed, t, latestRound, rate, fromAddress, tx)
+	txs.track(t.chain, privateKey, tx, func(receipt *types.Receipt, err error) {
+		t.txSettled(tx.Hash(), txStatus(err))
+		history.settleTransmission(tx.Hash(), receipt, err)
+		observeSettled(t.feed, t, sentAt, receipt, err)
+		if receipt != nil {
+			if fee, err := minedFee(context.TODO(), t.chain, receipt); err != nil {
+				log.Warn("Failed to read transaction fee", "target", t, "hash", receipt.TxHash, "err", err)
+			} else {
+				balances.recordSpend(t.chain.name, fromAddress, fee)
+			}
+		}
+		done(receipt, err)
+	})
+	return tx, nil
 }
 
 func loadSigningKey(keyfiles []string, password string) []*ecdsa.PrivateKey {
@@ -335,14 +237,3 @@ func loadSigningKey(keyfiles []string, password string) []*ecdsa.PrivateKey {
 	}
 	return PrivateKey
 }
-
-func MinutesDiffFromTimestamp(timestamp int64) int {
-	t := time.Unix(timestamp, 0)
-	return MinutesDiff(t)
-}
-
-func MinutesDiff(t time.Time) int {
-	now := time.Now()
-	diff := now.Sub(t)
-	return int(diff.Minutes())
-}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/classzz/go-classzz-v2/core/types"
+	"github.com/classzz/go-classzz-v2/metrics"
+	"github.com/classzz/go-classzz-v2/metrics/prometheus"
+)
+
+// Skip causes counted by countSkip.
+const (
+	skipPolicy     = "policy"       // within deviation threshold and heartbeat
+	skipOutOfRange = "out_of_range" // answer rejected by the out of range policy
+	skipBusy       = "busy"         // target paused or transmission pending
+	skipConsensus  = "consensus"    // another node transmits or no quorum
+	skipNoSigner   = "no_signer"    // no usable signing key
+)
+
+// metricName joins parts into a registry name. The Prometheus exporter turns
+// '/' into '_', so every part is reduced to [a-z0-9_].
+func metricName(parts ...string) string {
+	clean := make([]string, len(parts)+1)
+	clean[0] = "oracle"
+	for i, p := range parts {
+		clean[i+1] = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+				return r
+			case r >= 'A' && r <= 'Z':
+				return r + 'a' - 'A'
+			}
+			return '_'
+		}, p)
+	}
+	return strings.Join(clean, "/")
+}
+
+func targetID(t *aggregatorTarget) string {
+	return t.chain.name + "_" + t.address.Hex()
+}
+
+func histogram(name string) metrics.Histogram {
+	return metrics.GetOrRegisterHistogram(name, nil, metrics.NewExpDecaySample(1028, 0.015))
+}
+
+func ratFloat(r *big.Rat) float64 {
+	f, _ := r.Float64()
+	return f
+}
+
+// metricsHandler serves the default registry in Prometheus text format.
+func metricsHandler() http.Handler {
+	return prometheus.Handler(metrics.DefaultRegistry)
+}
+
+// observeAggregate records the sources and the aggregated price of a tick.
+func observeAggregate(feed string, report *aggregateReport, err error) {
+	for _, o := range append(append([]*Observation{}, report.Accepted...), report.Rejected...) {
+		metrics.GetOrRegisterGaugeFloat64(metricName("feed", feed, "source", o.Source, "price"), nil).Update(ratFloat(o.Price))
+	}
+	for id := range report.Errors {
+		metrics.GetOrRegisterCounter(metricName("feed", feed, "source", id, "errors"), nil).Inc(1)
+	}
+	for id, d := range report.Latency {
+		histogram(metricName("feed", feed, "source", id, "fetch_ms")).Update(d.Milliseconds())
+	}
+	if err == nil {
+		metrics.GetOrRegisterGaugeFloat64(metricName("feed", feed, "price"), nil).Update(ratFloat(report.Median))
+	}
+}
+
+// observeRound records the on-chain answer of t and the deviation of answer
+// from it.
+func observeRound(feed string, t *aggregatorTarget, latest roundData, d updateDecision) {
+	unit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(t.decimals)), nil)
+	onchain := ratFloat(new(big.Rat).SetFrac(latest.Answer, unit))
+	metrics.GetOrRegisterGaugeFloat64(metricName("feed", feed, "target", targetID(t), "answer"), nil).Update(onchain)
+	metrics.GetOrRegisterGaugeFloat64(metricName("feed", feed, "target", targetID(t), "deviation_percent"), nil).Update(d.DeviationBps / 100)
+}
+
+// registerTargetMetrics adds the gauges of t computed on scrape.
+func registerTargetMetrics(feed string, t *aggregatorTarget) {
+	metrics.NewRegisteredFunctionalGaugeFloat64(metricName("feed", feed, "target", targetID(t), "seconds_since_update"), nil, func() float64 {
+		t.state.mu.RLock()
+		defer t.state.mu.RUnlock()
+		if t.state.data.Answer == nil {
+			return 0
+		}
+		return time.Since(t.state.data.UpdatedAt).Seconds()
+	})
+}
+
+// countSkip counts a tick that did not transmit to a target.
+func countSkip(feed, cause string) {
+	metrics.GetOrRegisterCounter(metricName("feed", feed, "skipped", cause), nil).Inc(1)
+}
+
+// countSent counts a broadcast transmission.
+func countSent(feed string) {
+	metrics.GetOrRegisterCounter(metricName("feed", feed, "transmits", "sent"), nil).Inc(1)
+}
+
+// observeSettled records the outcome of a transmission broadcast at sentAt.
+func observeSettled(feed string, t *aggregatorTarget, sentAt time.Time, receipt *types.Receipt, err error) {
+	var rerr *revertError
+	switch {
+	case err == nil:
+		metrics.GetOrRegisterCounter(metricName("feed", feed, "transmits", "succeeded"), nil).Inc(1)
+	case errors.As(err, &rerr):
+		metrics.GetOrRegisterCounter(metricName("feed", feed, "transmits", "reverted", revertLabel(rerr)), nil).Inc(1)
+	default:
+		metrics.GetOrRegisterCounter(metricName("feed", feed, "transmits", "failed"), nil).Inc(1)
+	}
+	if receipt != nil {
+		histogram(metricName("chain", t.chain.name, "confirmation_ms")).Update(time.Since(sentAt).Milliseconds())
+		histogram(metricName("chain", t.chain.name, "gas_used")).Update(int64(receipt.GasUsed))
+	}
+}
+
+func weiToEther(wei *big.Int) float64 {
+	return ratFloat(new(big.Rat).SetFrac(wei, big.NewInt(1e18)))
+}
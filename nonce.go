@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/czzclient"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+// nonceResyncInterval is how long an idle account trusts its local nonce
+// before asking the chain again.
+const nonceResyncInterval = time.Minute
+
+// nonces is shared by every feed so that signers used by several feeds
+// never race on a nonce.
+var nonces = newNonceManager()
+
+type nonceKey struct {
+	chain   string
+	address common.Address
+}
+
+// nonceAccount tracks the nonces of one signer on one chain. Its lock is
+// held from allocation until the transaction is broadcast, so sends from the
+// same account are serialized.
+type nonceAccount struct {
+	lock     sync.Mutex
+	next     uint64
+	synced   bool
+	syncedAt time.Time
+	inflight map[uint64]common.Hash
+}
+
+// nonceManager hands out nonces per (chain, address).
+type nonceManager struct {
+	mu       sync.Mutex
+	accounts map[nonceKey]*nonceAccount
+}
+
+func newNonceManager() *nonceManager {
+	return &nonceManager{accounts: make(map[nonceKey]*nonceAccount)}
+}
+
+func (m *nonceManager) account(chain string, addr common.Address) *nonceAccount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := nonceKey{chain, addr}
+	acc, ok := m.accounts[key]
+	if !ok {
+		acc = &nonceAccount{inflight: make(map[uint64]common.Hash)}
+		m.accounts[key] = acc
+	}
+	return acc
+}
+
+// nonceLease is an allocated nonce. Exactly one of commit or release must be
+// called once the broadcast attempt is over.
+type nonceLease struct {
+	chain   string
+	address common.Address
+	Nonce   uint64
+	acc     *nonceAccount
+}
+
+// acquire allocates the next nonce of addr on chain, syncing with the
+// pending state of the node when the local view may be stale.
+func (m *nonceManager) acquire(ctx context.Context, chain string, client *czzclient.Client, addr common.Address) (*nonceLease, error) {
+	acc := m.account(chain, addr)
+	acc.lock.Lock()
+
+	if !acc.synced || (len(acc.inflight) == 0 && time.Since(acc.syncedAt) > nonceResyncInterval) {
+		pending, err := client.PendingNonceAt(ctx, addr)
+		if err != nil {
+			acc.lock.Unlock()
+			return nil, err
+		}
+		if acc.synced && pending != acc.next {
+			log.Debug("Nonce resynced", "chain", chain, "address", addr, "local", acc.next, "pending", pending)
+		}
+		for n := range acc.inflight {
+			if n < pending {
+				delete(acc.inflight, n)
+			}
+		}
+		acc.next, acc.synced, acc.syncedAt = pending, true, time.Now()
+	}
+	return &nonceLease{chain: chain, address: addr, Nonce: acc.next, acc: acc}, nil
+}
+
+// commit records that the transaction hash was broadcast with the leased nonce.
+func (l *nonceLease) commit(hash common.Hash) {
+	l.acc.inflight[l.Nonce] = hash
+	if l.Nonce >= l.acc.next {
+		l.acc.next = l.Nonce + 1
+	}
+	log.Debug("Nonce used", "chain", l.chain, "address", l.address, "nonce", l.Nonce, "hash", hash, "inflight", len(l.acc.inflight))
+	l.acc.lock.Unlock()
+}
+
+// release gives the nonce back after a failed broadcast. Nonce errors from
+// the node force a resync before the next allocation.
+func (l *nonceLease) release(err error) {
+	if isNonceError(err) {
+		log.Warn("Nonce out of sync", "chain", l.chain, "address", l.address, "nonce", l.Nonce, "err", err)
+		l.acc.synced = false
+	}
+	l.acc.lock.Unlock()
+}
+
+// done drops a mined or abandoned transaction from the in-flight set.
+func (m *nonceManager) done(chain string, addr common.Address, nonce uint64) {
+	acc := m.account(chain, addr)
+	acc.lock.Lock()
+	defer acc.lock.Unlock()
+	delete(acc.inflight, nonce)
+}
+
+// replaced records a replacement broadcast for an in-flight nonce.
+func (m *nonceManager) replaced(chain string, addr common.Address, nonce uint64, hash common.Hash) {
+	acc := m.account(chain, addr)
+	acc.lock.Lock()
+	defer acc.lock.Unlock()
+	acc.inflight[nonce] = hash
+}
+
+// invalidate forces a resync with the chain before the next allocation.
+func (m *nonceManager) invalidate(chain string, addr common.Address) {
+	acc := m.account(chain, addr)
+	acc.lock.Lock()
+	defer acc.lock.Unlock()
+	acc.synced = false
+}
+
+// isNonceError reports whether err means the node disagrees with our nonce.
+func isNonceError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "nonce too low") ||
+		strings.Contains(msg, "nonce too high") ||
+		strings.Contains(msg, "replacement transaction underpriced")
+}
+
+// isKnownTx reports whether err means the node already has this exact
+// transaction, so it was broadcast after all.
+func isKnownTx(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "already known") || strings.Contains(msg, "known transaction")
+}
+
+// nonceState is a snapshot of one account for debugging.
+type nonceState struct {
+	Chain    string                 `json:"chain"`
+	Address  common.Address         `json:"address"`
+	Next     uint64                 `json:"next"`
+	Synced   bool                   `json:"synced"`
+	SyncedAt time.Time              `json:"synced_at"`
+	Inflight map[uint64]common.Hash `json:"inflight"`
+}
+
+// snapshot returns the state of every known account.
+func (m *nonceManager) snapshot() []nonceState {
+	m.mu.Lock()
+	keys := make([]nonceKey, 0, len(m.accounts))
+	accs := make([]*nonceAccount, 0, len(m.accounts))
+	for k, acc := range m.accounts {
+		keys = append(keys, k)
+		accs = append(accs, acc)
+	}
+	m.mu.Unlock()
+
+	states := make([]nonceState, len(keys))
+	for i, acc := range accs {
+		acc.lock.Lock()
+		inflight := make(map[uint64]common.Hash, len(acc.inflight))
+		for n, h := range acc.inflight {
+			inflight[n] = h
+		}
+		states[i] = nonceState{
+			Chain:    keys[i].chain,
+			Address:  keys[i].address,
+			Next:     acc.next,
+			Synced:   acc.synced,
+			SyncedAt: acc.syncedAt,
+			Inflight: inflight,
+		}
+		acc.lock.Unlock()
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Chain != states[j].Chain {
+			return states[i].Chain < states[j].Chain
+		}
+		return states[i].Address.Hex() < states[j].Address.Hex()
+	})
+	return states
+}
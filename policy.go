@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+)
+
+const (
+	defaultDeviationBps = 500
+	defaultHeartbeat    = 60 * time.Minute
+)
+
+// updatePolicy decides whether a new answer is worth a transmission given
+// the latest on-chain round.
+type updatePolicy struct {
+	deviationBps int64
+	heartbeat    time.Duration
+}
+
+// updateDecision is the outcome of updatePolicy.decide.
+type updateDecision struct {
+	Submit       bool
+	Reason       string
+	DeviationBps float64       // distance of the answer from the on-chain answer
+	Age          time.Duration // age of the on-chain answer
+}
+
+func newUpdatePolicy(coin config.Coins) (*updatePolicy, error) {
+	heartbeat, err := config.ParseDuration(coin.Heartbeat, defaultHeartbeat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid heartbeat: %v", err)
+	}
+	p := &updatePolicy{
+		deviationBps: coin.DeviationBps,
+		heartbeat:    heartbeat,
+	}
+	if p.deviationBps < 0 {
+		return nil, fmt.Errorf("negative deviation_bps %d", p.deviationBps)
+	}
+	if p.deviationBps == 0 {
+		p.deviationBps = defaultDeviationBps
+	}
+	return p, nil
+}
+
+// decide compares answer with the on-chain answer last updated at updatedAt.
+// A round is submitted when the relative change reaches the deviation
+// threshold or the on-chain answer is older than the heartbeat.
+func (p *updatePolicy) decide(answer, onchain *big.Int, updatedAt, now time.Time) updateDecision {
+	d := updateDecision{Age: now.Sub(updatedAt)}
+	if onchain == nil || onchain.Sign() == 0 {
+		d.Submit, d.Reason = true, "no on-chain answer"
+		return d
+	}
+	diff := new(big.Int).Sub(answer, onchain)
+	diff.Abs(diff)
+	dev := new(big.Rat).SetFrac(new(big.Int).Mul(diff, big.NewInt(10000)), new(big.Int).Abs(onchain))
+	d.DeviationBps, _ = dev.Float64()
+
+	switch {
+	case dev.Cmp(big.NewRat(p.deviationBps, 1)) >= 0:
+		d.Submit, d.Reason = true, "deviation threshold reached"
+	case d.Age >= p.heartbeat:
+		d.Submit, d.Reason = true, "heartbeat expired"
+	default:
+		d.Reason = "within deviation threshold and heartbeat"
+	}
+	return d
+}
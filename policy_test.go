@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+)
+
+func TestUpdatePolicyDecide(t *testing.T) {
+	p, err := newUpdatePolicy(config.Coins{DeviationBps: 50, Heartbeat: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	fresh := now.Add(-time.Minute)
+
+	tests := []struct {
+		name      string
+		answer    int64
+		onchain   *big.Int
+		updatedAt time.Time
+		submit    bool
+		reason    string
+		devBps    float64
+	}{
+		{"no change", 100000, big.NewInt(100000), fresh, false, "within deviation threshold and heartbeat", 0},
+		{"just below threshold", 100499, big.NewInt(100000), fresh, false, "within deviation threshold and heartbeat", 49.9},
+		{"exactly at threshold", 100500, big.NewInt(100000), fresh, true, "deviation threshold reached", 50},
+		{"exactly at threshold downwards", 99500, big.NewInt(100000), fresh, true, "deviation threshold reached", 50},
+		{"negative on-chain answer", -100500, big.NewInt(-100000), fresh, true, "deviation threshold reached", 50},
+		{"heartbeat not yet expired", 100000, big.NewInt(100000), now.Add(-time.Hour + time.Second), false, "within deviation threshold and heartbeat", 0},
+		{"heartbeat expired", 100000, big.NewInt(100000), now.Add(-time.Hour), true, "heartbeat expired", 0},
+		{"zero on-chain answer", 100000, big.NewInt(0), fresh, true, "no on-chain answer", 0},
+		{"missing on-chain answer", 100000, nil, time.Time{}, true, "no on-chain answer", 0},
+	}
+	for _, tt := range tests {
+		d := p.decide(big.NewInt(tt.answer), tt.onchain, tt.updatedAt, now)
+		if d.Submit != tt.submit || d.Reason != tt.reason {
+			t.Errorf("%s: submit %v (%s), want %v (%s)", tt.name, d.Submit, d.Reason, tt.submit, tt.reason)
+		}
+		if d.DeviationBps != tt.devBps {
+			t.Errorf("%s: deviation %v bps, want %v", tt.name, d.DeviationBps, tt.devBps)
+		}
+		if d.Age != now.Sub(tt.updatedAt) {
+			t.Errorf("%s: age %v, want %v", tt.name, d.Age, now.Sub(tt.updatedAt))
+		}
+	}
+}
+
+func TestUpdatePolicyDefaults(t *testing.T) {
+	p, err := newUpdatePolicy(config.Coins{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.deviationBps != defaultDeviationBps || p.heartbeat != defaultHeartbeat {
+		t.Fatalf("defaults %d bps / %v, want %d bps / %v", p.deviationBps, p.heartbeat, defaultDeviationBps, defaultHeartbeat)
+	}
+	if _, err := newUpdatePolicy(config.Coins{DeviationBps: -1}); err == nil {
+		t.Fatal("negative deviation_bps accepted")
+	}
+	if _, err := newUpdatePolicy(config.Coins{Heartbeat: "soon"}); err == nil {
+		t.Fatal("invalid heartbeat accepted")
+	}
+}
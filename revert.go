@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	classzz "github.com/classzz/go-classzz-v2"
+	"github.com/classzz/go-classzz-v2/accounts/abi"
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/common/hexutil"
+	"github.com/classzz/go-classzz-v2/core/types"
+	"github.com/classzz/go-classzz-v2/czzclient"
+	"github.com/classzz/go-classzz-v2/metrics"
+	"github.com/classzz/go-classzz-v2/rpc"
+)
+
+// Revert reasons of OffchainAggregator.transmit.
+var (
+	errSignerNotExist     = errors.New("signer does not exist")
+	errRepeatedSubmission = errors.New("Admin repeated submission")
+	errStaleRound         = errors.New("roundId > s_latestAggregatorRoundId")
+	errAnswerOutOfRange   = errors.New("median is out of min-max range")
+)
+
+var knownReverts = []error{
+	errSignerNotExist,
+	errRepeatedSubmission,
+	errStaleRound,
+	errAnswerOutOfRange,
+}
+
+// aggregatorABI is the parsed Aggregator binding ABI.
+var aggregatorABI, _ = abi.JSON(strings.NewReader(AggregatorABI))
+
+// revertLabel returns a short metric friendly name of a revert.
+func revertLabel(err error) string {
+	switch {
+	case errors.Is(err, errSignerNotExist):
+		return "signer_not_exist"
+	case errors.Is(err, errRepeatedSubmission):
+		return "repeated_submission"
+	case errors.Is(err, errStaleRound):
+		return "stale_round"
+	case errors.Is(err, errAnswerOutOfRange):
+		return "out_of_range"
+	}
+	return "other"
+}
+
+// countRevert records a revert seen at stage ("simulation" or "receipt").
+func countRevert(stage string, err error) {
+	metrics.GetOrRegisterCounter("oracle/reverts/"+stage+"/"+revertLabel(err), nil).Inc(1)
+}
+
+// revertError is a reverted call or transaction. It unwraps to the matching
+// known revert reason, if any.
+type revertError struct {
+	Reason string
+	known  error
+}
+
+func (e *revertError) Error() string {
+	if e.Reason == "" {
+		return "execution reverted"
+	}
+	return "execution reverted: " + e.Reason
+}
+
+func (e *revertError) Unwrap() error { return e.known }
+
+func newRevertError(reason string) *revertError {
+	e := &revertError{Reason: reason}
+	for _, known := range knownReverts {
+		if reason == known.Error() {
+			e.known = known
+		}
+	}
+	return e
+}
+
+// decodeRevert turns the error of an eth_call into a revertError, or returns
+// nil if err is not a revert.
+func decodeRevert(err error) *revertError {
+	if err == nil {
+		return nil
+	}
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) {
+		if s, ok := dataErr.ErrorData().(string); ok {
+			if data, derr := hexutil.Decode(s); derr == nil {
+				if reason, uerr := abi.UnpackRevert(data); uerr == nil {
+					return newRevertError(reason)
+				}
+			}
+		}
+	}
+	msg := err.Error()
+	if i := strings.Index(msg, "execution reverted"); i >= 0 {
+		reason := strings.TrimPrefix(msg[i+len("execution reverted"):], ":")
+		return newRevertError(strings.TrimSpace(reason))
+	}
+	return nil
+}
+
+// replayRevert re-executes a failed transaction with eth_call at the block it
+// was mined in to recover its revert reason.
+func replayRevert(ctx context.Context, client *czzclient.Client, from common.Address, tx *types.Transaction, block *big.Int) error {
+	msg := classzz.CallMsg{
+		From:  from,
+		To:    tx.To(),
+		Gas:   tx.Gas(),
+		Value: tx.Value(),
+		Data:  tx.Data(),
+	}
+	_, err := client.CallContract(ctx, msg, block)
+	if rerr := decodeRevert(err); rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		return fmt.Errorf("execution reverted, replay failed: %v", err)
+	}
+	return &revertError{}
+}
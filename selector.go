@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/crypto"
+	"github.com/classzz/go-classzz-v2/czzclient"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+// Signer selection strategies.
+const (
+	strategyRoundRobin = "round_robin"
+	strategyLRU        = "lru"
+	strategyBalance    = "balance"
+	strategyAll        = "all"
+)
+
+// signer is a loaded oracle key.
+type signer struct {
+	key     *ecdsa.PrivateKey
+	address common.Address
+}
+
+func newSigners(keys []*ecdsa.PrivateKey) []*signer {
+	signers := make([]*signer, len(keys))
+	for i, key := range keys {
+		signers[i] = &signer{key: key, address: crypto.PubkeyToAddress(key.PublicKey)}
+	}
+	return signers
+}
+
+// signerSelector chooses which of the usable signers transmit a round.
+// Candidates are always in key file order.
+type signerSelector interface {
+	pick(ctx context.Context, client *czzclient.Client, candidates []*signer) []*signer
+}
+
+func newSignerSelector(strategy string) (signerSelector, error) {
+	switch strategy {
+	case "", strategyRoundRobin:
+		return &roundRobinSelector{}, nil
+	case strategyLRU:
+		return &lruSelector{used: make(map[common.Address]time.Time)}, nil
+	case strategyBalance:
+		return &balanceSelector{}, nil
+	case strategyAll:
+		return allSelector{}, nil
+	}
+	return nil, fmt.Errorf("unknown signer strategy %q", strategy)
+}
+
+// roundRobinSelector picks the candidate following the last one used.
+type roundRobinSelector struct {
+	mu   sync.Mutex
+	last common.Address
+}
+
+func (s *roundRobinSelector) pick(ctx context.Context, client *czzclient.Client, candidates []*signer) []*signer {
+	if len(candidates) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := candidates[0]
+	for i, c := range candidates {
+		if c.address == s.last {
+			next = candidates[(i+1)%len(candidates)]
+			break
+		}
+	}
+	s.last = next.address
+	return []*signer{next}
+}
+
+// lruSelector picks the candidate that has not been picked for the longest time.
+type lruSelector struct {
+	mu   sync.Mutex
+	used map[common.Address]time.Time
+}
+
+func (s *lruSelector) pick(ctx context.Context, client *czzclient.Client, candidates []*signer) []*signer {
+	if len(candidates) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := candidates[0]
+	for _, c := range candidates[1:] {
+		if s.used[c.address].Before(s.used[next.address]) {
+			next = c
+		}
+	}
+	s.used[next.address] = time.Now()
+	return []*signer{next}
+}
+
+// balanceSelector picks the candidate holding the most native currency.
+type balanceSelector struct{}
+
+func (balanceSelector) pick(ctx context.Context, client *czzclient.Client, candidates []*signer) []*signer {
+	var (
+		next *signer
+		best *big.Int
+	)
+	for _, c := range candidates {
+		balance, err := client.BalanceAt(ctx, c.address, nil)
+		if err != nil {
+			log.Warn("BalanceAt", "address", c.address, "err", err)
+			continue
+		}
+		if best == nil || balance.Cmp(best) > 0 {
+			next, best = c, balance
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	return []*signer{next}
+}
+
+// allSelector lets every candidate transmit.
+type allSelector struct{}
+
+func (allSelector) pick(ctx context.Context, client *czzclient.Client, candidates []*signer) []*signer {
+	return candidates
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/classzz/go-classzz-v2/accounts/abi/bind"
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+const (
+	signerPollInterval = 5 * time.Minute
+	signerScanWindow   = 5000 // blocks per ConfigSet query, within common RPC limits
+)
+
+// signerSet is the signer list of an aggregator rebuilt from its ConfigSet
+// events, since the contract has no getter for s_signers.
+type signerSet struct {
+	mu      sync.RWMutex
+	known   bool // a ConfigSet event was found
+	signers map[common.Address]bool
+	order   []common.Address // signers in ConfigSet order
+	block   uint64           // block of the ConfigSet event in effect
+	scanned uint64           // last block searched for ConfigSet events
+}
+
+// authorized reports whether addr is a signer of the aggregator. Every
+// address is accepted while the signer list is unknown.
+func (s *signerSet) authorized(addr common.Address) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.known || s.signers[addr]
+}
+
+// first returns the first signer of the aggregator, if the list is known
+// and not empty.
+func (s *signerSet) first() (common.Address, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.known || len(s.order) == 0 {
+		return common.Address{}, false
+	}
+	return s.order[0], true
+}
+
+// apply installs the signers of a ConfigSet event mined in block.
+func (s *signerSet) apply(signers []common.Address, block uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.known && block < s.block {
+		return false
+	}
+	s.known, s.block = true, block
+	s.signers = make(map[common.Address]bool, len(signers))
+	s.order = append([]common.Address(nil), signers...)
+	for _, addr := range signers {
+		s.signers[addr] = true
+	}
+	return true
+}
+
+// applySigners installs the signers of a ConfigSet event mined in block. A
+// new configuration re-enables the listed signers the contract rejected
+// before, since it may have authorized them again.
+func (t *aggregatorTarget) applySigners(signers []common.Address, block uint64) bool {
+	if !t.signers.apply(signers, block) {
+		return false
+	}
+	t.mu.Lock()
+	var enabled []common.Address
+	for _, addr := range signers {
+		if t.disabled[addr] {
+			delete(t.disabled, addr)
+			enabled = append(enabled, addr)
+		}
+	}
+	t.mu.Unlock()
+	for _, addr := range enabled {
+		log.Info("Signer re-enabled by new aggregator config", "target", t, "signer", addr, "block", block)
+		resolveAlert(alertSignerDisabled, t.feed, "target", t, "signer", addr)
+	}
+	return true
+}
+
+// loadSigners scans ConfigSet events from fromBlock up to the current head,
+// signerScanWindow blocks per query, and keeps the most recent signer list.
+func (t *aggregatorTarget) loadSigners(ctx context.Context, fromBlock uint64) error {
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		return err
+	}
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	filterer, err := NewAggregatorFilterer(t.address, client)
+	if err != nil {
+		return err
+	}
+	for start := fromBlock; start <= head; start += signerScanWindow {
+		end := start + signerScanWindow - 1
+		if end > head {
+			end = head
+		}
+		it, err := filterer.FilterConfigSet(&bind.FilterOpts{Start: start, End: &end, Context: ctx})
+		if err != nil {
+			return err
+		}
+		for it.Next() {
+			if t.applySigners(it.Event.Signers, it.Event.Raw.BlockNumber) {
+				log.Info("Aggregator signers", "target", t, "block", it.Event.Raw.BlockNumber, "signers", it.Event.Signers)
+			}
+		}
+		err = it.Error()
+		it.Close()
+		if err != nil {
+			return err
+		}
+		t.signers.mu.Lock()
+		t.signers.scanned = end
+		t.signers.mu.Unlock()
+	}
+	return nil
+}
+
+// reportSigners warns about loaded keys that may not transmit to t.
+func (t *aggregatorTarget) reportSigners(feed string, keys []common.Address) {
+	t.signers.mu.RLock()
+	known := t.signers.known
+	t.signers.mu.RUnlock()
+	if !known {
+		log.Warn("Aggregator signers unknown, using every key", "feed", feed, "target", t)
+		return
+	}
+	authorized := 0
+	for _, addr := range keys {
+		if t.signers.authorized(addr) {
+			authorized++
+		} else {
+			log.Warn("Loaded key is not an aggregator signer", "feed", feed, "target", t, "address", addr)
+		}
+	}
+	if authorized == 0 && len(keys) > 0 {
+		log.Error("No loaded key is an aggregator signer", "feed", feed, "target", t)
+	}
+}
+
+// watchSigners follows ConfigSet events, by subscription where the endpoint
+// supports it and by polling otherwise.
+func (t *aggregatorTarget) watchSigners(feed string, keys []common.Address) {
+	for {
+		if err := t.subscribeSigners(feed, keys); err != nil {
+			log.Debug("ConfigSet subscription unavailable, polling", "target", t, "err", err)
+		}
+		time.Sleep(signerPollInterval)
+
+		t.signers.mu.RLock()
+		from := t.signers.scanned + 1
+		block := t.signers.block
+		t.signers.mu.RUnlock()
+		if err := t.loadSigners(context.Background(), from); err != nil {
+			log.Warn("Failed to poll aggregator signers", "target", t, "err", err)
+			continue
+		}
+		t.signers.mu.RLock()
+		changed := t.signers.block != block
+		t.signers.mu.RUnlock()
+		if changed {
+			t.reportSigners(feed, keys)
+		}
+	}
+}
+
+// subscribeSigners applies ConfigSet events until the subscription fails.
+func (t *aggregatorTarget) subscribeSigners(feed string, keys []common.Address) error {
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		return err
+	}
+	filterer, err := NewAggregatorFilterer(t.address, client)
+	if err != nil {
+		return err
+	}
+	sink := make(chan *AggregatorConfigSet)
+	sub, err := filterer.WatchConfigSet(&bind.WatchOpts{}, sink)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	for {
+		select {
+		case ev := <-sink:
+			if t.applySigners(ev.Signers, ev.Raw.BlockNumber) {
+				log.Info("Aggregator signers changed", "target", t, "block", ev.Raw.BlockNumber, "signers", ev.Signers)
+				t.reportSigners(feed, keys)
+			}
+		case err := <-sub.Err():
+			return err
+		}
+	}
+}
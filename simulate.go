@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	classzz "github.com/classzz/go-classzz-v2"
+	"github.com/classzz/go-classzz-v2/accounts/abi/bind"
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/czzclient"
+)
+
+const defaultGasMarginPercent = 20
+
+// simulateTransmit executes transmit(round, answer) from the signer against
+// the pending state and returns the gas limit to use: the configured limit
+// of the chain, or the estimate plus the safety margin. A revert is returned
+// as a revertError.
+func simulateTransmit(ctx context.Context, t *aggregatorTarget, client *czzclient.Client, from common.Address, round uint32, answer *big.Int) (uint64, error) {
+	caller, err := NewAggregatorCaller(t.address, client)
+	if err != nil {
+		return 0, err
+	}
+	raw := &AggregatorCallerRaw{Contract: caller}
+	var out []interface{}
+	opts := &bind.CallOpts{Pending: true, From: from, Context: ctx}
+	if err := raw.Call(opts, &out, "transmit", round, answer); err != nil {
+		if rerr := decodeRevert(err); rerr != nil {
+			return 0, rerr
+		}
+		return 0, fmt.Errorf("simulate transmit: %v", err)
+	}
+	if t.chain.gas.GasLimit != 0 {
+		return t.chain.gas.GasLimit, nil
+	}
+
+	data, err := aggregatorABI.Pack("transmit", round, answer)
+	if err != nil {
+		return 0, err
+	}
+	gas, err := client.EstimateGas(ctx, classzz.CallMsg{From: from, To: &t.address, Data: data})
+	if err != nil {
+		if rerr := decodeRevert(err); rerr != nil {
+			return 0, rerr
+		}
+		return 0, fmt.Errorf("estimate gas: %v", err)
+	}
+	margin := t.chain.gas.GasMarginPercent
+	if margin == 0 {
+		margin = defaultGasMarginPercent
+	}
+	return gas * uint64(100+margin) / 100, nil
+}
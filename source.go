@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+)
+
+// Observation is a single price reading returned by a PriceSource.
+type Observation struct {
+	Source    string
+	Price     *big.Rat
+	Timestamp time.Time
+	Meta      map[string]string
+}
+
+// PriceSource fetches the current price of a feed from one upstream API.
+type PriceSource interface {
+	Name() string
+	Fetch(ctx context.Context) (*Observation, error)
+}
+
+// sourceFactory builds a PriceSource from its configuration.
+type sourceFactory func(src config.Source) PriceSource
+
+var sourceFactories = map[string]sourceFactory{}
+
+// registerSource makes an adapter available under name. Adapters call it
+// from their init function.
+func registerSource(name string, factory sourceFactory) {
+	if _, ok := sourceFactories[name]; ok {
+		panic("price source registered twice: " + name)
+	}
+	sourceFactories[name] = factory
+}
+
+// newPriceSource looks up the adapter registered as src.Name.
+func newPriceSource(src config.Source) (PriceSource, error) {
+	factory, ok := sourceFactories[src.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown price source %q (have %v)", src.Name, sourceNames())
+	}
+	return factory(src), nil
+}
+
+func sourceNames() []string {
+	names := make([]string, 0, len(sourceFactories))
+	for name := range sourceFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var httpClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// getJSON performs a GET request against url and decodes the body into v.
+func getJSON(ctx context.Context, url string, headers map[string]string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for k, val := range headers {
+		req.Header.Set(k, val)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// parsePrice parses a decimal price string exactly.
+func parsePrice(s string) (*big.Rat, error) {
+	price, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid price %q", s)
+	}
+	if price.Sign() <= 0 {
+		return nil, fmt.Errorf("non-positive price %q", s)
+	}
+	return price, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+)
+
+type Ave struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		CirculatingSupply string      `json:"circulating_supply"`
+		MarketCap         string      `json:"market_cap"`
+		High24H           string      `json:"high_24h"`
+		Low24H            string      `json:"low_24h"`
+		Volume24H         string      `json:"volume_24h"`
+		TxCount24H        string      `json:"tx_count_24h"`
+		Amount24H         string      `json:"amount_24h"`
+		Turnover24H       string      `json:"turnover_24h"`
+		TotalSupply       string      `json:"total_supply"`
+		Price             string      `json:"price"`
+		Token             string      `json:"token"`
+		Chain             string      `json:"chain"`
+		Symbol            string      `json:"symbol"`
+		Decimal           int         `json:"decimal"`
+		Name              string      `json:"name"`
+		Holders           int         `json:"holders"`
+		IntroCn           string      `json:"intro_cn"`
+		IntroEn           string      `json:"intro_en"`
+		PriceChange       string      `json:"price_change"`
+		LogoUrl           interface{} `json:"logo_url"`
+		RiskLevel         int         `json:"risk_level"`
+		RiskInfo          interface{} `json:"risk_info"`
+		Appendix          string      `json:"appendix"`
+	} `json:"data"`
+}
+
+const defaultAveAuth = "0x2w3d7af564e4bfda1c483642db7200787135ffet"
+
+func init() {
+	registerSource("ave", func(src config.Source) PriceSource {
+		h := map[string]string{"Ave-Auth": defaultAveAuth}
+		for k, v := range src.Headers {
+			h[k] = v
+		}
+		return &aveSource{id: src.ID(), url: src.Url, headers: h}
+	})
+}
+
+// aveSource reads the token price from the Ave token API.
+type aveSource struct {
+	id      string
+	url     string
+	headers map[string]string
+}
+
+func (s *aveSource) Name() string { return s.id }
+
+func (s *aveSource) Fetch(ctx context.Context) (*Observation, error) {
+	var res Ave
+	if err := getJSON(ctx, s.url, s.headers, &res); err != nil {
+		return nil, err
+	}
+	if res.Data.Price == "" {
+		return nil, fmt.Errorf("ave: empty price (code %d: %s)", res.Code, res.Msg)
+	}
+	price, err := parsePrice(res.Data.Price)
+	if err != nil {
+		return nil, err
+	}
+	return &Observation{
+		Source:    s.Name(),
+		Price:     price,
+		Timestamp: time.Now(),
+		Meta: map[string]string{
+			"url":        s.url,
+			"symbol":     res.Data.Symbol,
+			"chain":      res.Data.Chain,
+			"volume_24h": res.Data.Volume24H,
+		},
+	}, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/classzz/classzz-orace/config"
+)
+
+type Candlestick struct {
+	QuoteVolume   string `json:"quoteVolume"`
+	BaseVolume    string `json:"baseVolume"`
+	HighestBid    string `json:"highestBid"`
+	High24Hr      string `json:"high24hr"`
+	Last          string `json:"last"`
+	LowestAsk     string `json:"lowestAsk"`
+	Elapsed       string `json:"elapsed"`
+	Result        string `json:"result"`
+	Low24Hr       string `json:"low24hr"`
+	PercentChange string `json:"percentChange"`
+}
+
+func init() {
+	registerSource("candlestick", func(src config.Source) PriceSource {
+		return &candlestickSource{id: src.ID(), url: src.Url, headers: src.Headers}
+	})
+}
+
+// candlestickSource reads the last traded price from a ticker endpoint
+// returning a Candlestick document.
+type candlestickSource struct {
+	id      string
+	url     string
+	headers map[string]string
+}
+
+func (s *candlestickSource) Name() string { return s.id }
+
+func (s *candlestickSource) Fetch(ctx context.Context) (*Observation, error) {
+	var res Candlestick
+	if err := getJSON(ctx, s.url, s.headers, &res); err != nil {
+		return nil, err
+	}
+	price, err := parsePrice(res.Last)
+	if err != nil {
+		return nil, err
+	}
+	return &Observation{
+		Source:    s.Name(),
+		Price:     price,
+		Timestamp: time.Now(),
+		Meta: map[string]string{
+			"url":         s.url,
+			"highest_bid": res.HighestBid,
+			"lowest_ask":  res.LowestAsk,
+			"base_volume": res.BaseVolume,
+		},
+	}, nil
+}
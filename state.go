@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/classzz/go-classzz-v2/accounts/abi/bind"
+	"github.com/classzz/go-classzz-v2/czzclient"
+	"github.com/classzz/go-classzz-v2/log"
+)
+
+// statePollInterval is how often the latest round is polled while no event
+// subscription is available, and how long a polled round is trusted.
+const statePollInterval = 15 * time.Second
+
+// roundData is the latest round of an aggregator.
+type roundData struct {
+	Round     uint32
+	Answer    *big.Int
+	UpdatedAt time.Time
+}
+
+// roundState caches the latest round of an aggregator, fed by
+// NewTransmission and AnswerUpdated events or by polling latestRoundData.
+type roundState struct {
+	mu      sync.RWMutex
+	data    roundData
+	live    bool      // a subscription keeps data current
+	fetched time.Time // last confirmation by an event or a poll, zero when invalidated
+}
+
+// update stores d unless a later round is already known. The update time of
+// a round already known is kept, so every source agrees on it.
+func (s *roundState) update(d roundData) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Answer != nil && d.Round < s.data.Round {
+		return false
+	}
+	if s.data.Answer != nil && d.Round == s.data.Round && !s.data.UpdatedAt.IsZero() {
+		d.UpdatedAt = s.data.UpdatedAt
+	}
+	changed := s.data.Answer == nil || d.Round != s.data.Round || d.Answer.Cmp(s.data.Answer) != 0
+	s.data, s.fetched = d, time.Now()
+	return changed
+}
+
+// latest returns the cached round if it can be trusted without a new read.
+func (s *roundState) latest() (roundData, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.data.Answer == nil || s.fetched.IsZero() {
+		return roundData{}, false
+	}
+	return s.data, s.live || time.Since(s.fetched) < statePollInterval
+}
+
+// known reports whether a round was read at least once.
+func (s *roundState) known() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data.Answer != nil
+}
+
+// invalidate forces the next latestRound call to read the contract.
+func (s *roundState) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetched = time.Time{}
+}
+
+func (s *roundState) setLive(live bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live = live
+}
+
+// latestRound returns the latest round of t from the cache, reading it with
+// client when the cache is stale.
+func (t *aggregatorTarget) latestRound(ctx context.Context, client *czzclient.Client) (roundData, error) {
+	if d, ok := t.state.latest(); ok {
+		return d, nil
+	}
+	return t.refreshState(ctx, client)
+}
+
+// refreshState reads latestRoundData and stores it in the cache.
+func (t *aggregatorTarget) refreshState(ctx context.Context, client *czzclient.Client) (roundData, error) {
+	instance, err := NewAggregatorCaller(t.address, client)
+	if err != nil {
+		return roundData{}, err
+	}
+	latest, err := instance.LatestRoundData(&bind.CallOpts{Context: ctx})
+	if err != nil {
+		return roundData{}, err
+	}
+	d := roundData{
+		Round:     uint32(latest.RoundId.Uint64()),
+		Answer:    latest.Answer,
+		UpdatedAt: time.Unix(latest.UpdatedAt.Int64(), 0),
+	}
+	t.state.update(d)
+	return d, nil
+}
+
+// watchState keeps the round cache of t current, by subscription where the
+// endpoint supports it and by polling otherwise. A new subscription is tried
+// every signerPollInterval.
+func (t *aggregatorTarget) watchState(feed string) {
+	for {
+		if err := t.subscribeState(feed); err != nil {
+			log.Debug("Round subscription unavailable, polling", "target", t, "err", err)
+		}
+		t.state.setLive(false)
+		for deadline := time.Now().Add(signerPollInterval); time.Now().Before(deadline); time.Sleep(statePollInterval) {
+			client, err := t.chain.pool.Client()
+			if err != nil {
+				continue
+			}
+			if _, err := t.refreshState(context.Background(), client); err != nil {
+				log.Debug("Failed to poll latest round", "target", t, "err", err)
+				t.chain.pool.reportFailure(client, err)
+			}
+		}
+	}
+}
+
+// subscribeState applies NewTransmission and AnswerUpdated events until the
+// subscription fails. The latest round is read once subscribed so nothing
+// emitted before is missed.
+func (t *aggregatorTarget) subscribeState(feed string) error {
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		return err
+	}
+	filterer, err := NewAggregatorFilterer(t.address, client)
+	if err != nil {
+		return err
+	}
+	transmissions := make(chan *AggregatorNewTransmission)
+	txSub, err := filterer.WatchNewTransmission(&bind.WatchOpts{}, transmissions, nil)
+	if err != nil {
+		return err
+	}
+	defer txSub.Unsubscribe()
+	answers := make(chan *AggregatorAnswerUpdated)
+	answerSub, err := filterer.WatchAnswerUpdated(&bind.WatchOpts{}, answers, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer answerSub.Unsubscribe()
+
+	if _, err := t.refreshState(context.Background(), client); err != nil {
+		return err
+	}
+	t.state.setLive(true)
+	for {
+		select {
+		case ev := <-transmissions:
+			// The event has no update time; the contract records the
+			// timestamp of the block that mined it.
+			header, err := client.HeaderByNumber(context.Background(), new(big.Int).SetUint64(ev.Raw.BlockNumber))
+			if err != nil {
+				log.Debug("Failed to read transmission block, waiting for AnswerUpdated", "target", t, "block", ev.Raw.BlockNumber, "err", err)
+				continue
+			}
+			d := roundData{Round: ev.AggregatorRoundId, Answer: ev.Answer, UpdatedAt: time.Unix(int64(header.Time), 0)}
+			if t.state.update(d) {
+				log.Info("Aggregator round updated", "feed", feed, "target", t, "round", d.Round, "answer", d.Answer, "block", ev.Raw.BlockNumber)
+			}
+		case ev := <-answers:
+			d := roundData{Round: uint32(ev.RoundId.Uint64()), Answer: ev.Current, UpdatedAt: time.Unix(ev.UpdatedAt.Int64(), 0)}
+			if t.state.update(d) {
+				log.Info("Aggregator round updated", "feed", feed, "target", t, "round", d.Round, "answer", d.Answer, "block", ev.Raw.BlockNumber)
+			}
+		case err := <-txSub.Err():
+			return err
+		case err := <-answerSub.Err():
+			return err
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/classzz/go-classzz-v2/common"
+)
+
+// aggregatorTarget is an on-chain aggregator a feed writes to, together
+// with the immutable parameters read from it once it is reachable.
+type aggregatorTarget struct {
+	feed      string
+	chain     *evmChain
+	address   common.Address
+	fromBlock uint64 // first block searched for ConfigSet events
+	want      *uint8 // configured decimals, checked against the contract
+	decimals  uint8
+	minAnswer *big.Int
+	maxAnswer *big.Int
+	signers   signerSet
+	selector  signerSelector
+	state     roundState
+
+	mu        sync.Mutex
+	loaded    bool   // parameters and signers read
+	paused    bool   // set by the pause out of range policy
+	pending   int    // transmissions waiting to be mined
+	lastRound uint32 // round of the last transmission sent to this target
+	lastTx    common.Hash
+	lastSent  time.Time
+	lastState string                  // status of lastTx
+	failures  int                     // consecutive failed transmissions
+	disabled  map[common.Address]bool // signers rejected by the contract
+}
+
+// loadParams reads decimals and the answer range of the aggregator. A
+// configured decimals override must match the contract.
+func (t *aggregatorTarget) loadParams() error {
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		return err
+	}
+	instance, err := NewAggregator(t.address, client)
+	if err != nil {
+		return err
+	}
+	onchain, err := instance.Decimals(nil)
+	if err != nil {
+		t.chain.pool.reportFailure(client, err)
+		return fmt.Errorf("read decimals of %s: %v", t.address.String(), err)
+	}
+	if t.want != nil && *t.want != onchain {
+		return fmt.Errorf("configured decimals %d do not match %d of aggregator %s", *t.want, onchain, t.address.String())
+	}
+	minAnswer, err := instance.MinAnswer(nil)
+	if err != nil {
+		t.chain.pool.reportFailure(client, err)
+		return fmt.Errorf("read minAnswer of %s: %v", t.address.String(), err)
+	}
+	maxAnswer, err := instance.MaxAnswer(nil)
+	if err != nil {
+		t.chain.pool.reportFailure(client, err)
+		return fmt.Errorf("read maxAnswer of %s: %v", t.address.String(), err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.decimals, t.minAnswer, t.maxAnswer = onchain, minAnswer, maxAnswer
+	return nil
+}
+
+// inRange reports whether the aggregator accepts answer.
+func (t *aggregatorTarget) inRange(answer *big.Int) bool {
+	return answer.Cmp(t.minAnswer) >= 0 && answer.Cmp(t.maxAnswer) <= 0
+}
+
+// clamp returns answer limited to the accepted range of the aggregator.
+func (t *aggregatorTarget) clamp(answer *big.Int) *big.Int {
+	if answer.Cmp(t.minAnswer) < 0 {
+		return new(big.Int).Set(t.minAnswer)
+	}
+	if answer.Cmp(t.maxAnswer) > 0 {
+		return new(big.Int).Set(t.maxAnswer)
+	}
+	return answer
+}
+
+// scale converts price to the fixed-point answer of the aggregator,
+// rounding half away from zero.
+func (t *aggregatorTarget) scale(price *big.Rat) *big.Int {
+	return scalePrice(price, t.decimals)
+}
+
+// scalePrice returns price * 10^decimals rounded half away from zero.
+func scalePrice(price *big.Rat, decimals uint8) *big.Int {
+	unit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	num := new(big.Int).Mul(price.Num(), unit)
+	den := price.Denom()
+
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	rem.Abs(rem).Lsh(rem, 1)
+	if rem.Cmp(den) >= 0 {
+		if num.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	return quo
+}
+
+func (t *aggregatorTarget) String() string {
+	return t.chain.name + ":" + t.address.String()
+}
+
+// ready reports whether a new transmission may be started.
+func (t *aggregatorTarget) ready() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.loaded && !t.paused && t.pending == 0
+}
+
+func (t *aggregatorTarget) isLoaded() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.loaded
+}
+
+// setLoaded lets ticks transmit to t.
+func (t *aggregatorTarget) setLoaded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loaded = true
+}
+
+func (t *aggregatorTarget) pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = true
+}
+
+// begin marks a transmission as in progress.
+func (t *aggregatorTarget) begin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending++
+}
+
+// sent records a broadcast transmission for round.
+func (t *aggregatorTarget) sent(round uint32, hash common.Hash) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastRound, t.lastTx, t.lastSent, t.lastState = round, hash, time.Now(), txPending
+}
+
+// transmitOK resets the failure count and returns its previous value.
+func (t *aggregatorTarget) transmitOK() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.failures
+	t.failures = 0
+	return n
+}
+
+// transmitFailure counts a failed transmission and returns the number of
+// consecutive failures.
+func (t *aggregatorTarget) transmitFailure() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures++
+	return t.failures
+}
+
+// txSettled records the outcome of the transmission sent as hash.
+func (t *aggregatorTarget) txSettled(hash common.Hash, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if hash == t.lastTx {
+		t.lastState = status
+	}
+}
+
+// targetStatus is a snapshot of a target for the API.
+type targetStatus struct {
+	Target     string         `json:"target"`
+	Chain      string         `json:"chain"`
+	Address    common.Address `json:"address"`
+	Decimals   uint8          `json:"decimals"`
+	Paused     bool           `json:"paused"`
+	Pending    int            `json:"pending"`
+	LastRound  uint32         `json:"last_round,omitempty"`
+	LastTx     *common.Hash   `json:"last_tx,omitempty"`
+	LastSent   *time.Time     `json:"last_sent,omitempty"`
+	LastStatus string         `json:"last_status,omitempty"`
+}
+
+func (t *aggregatorTarget) status() targetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := targetStatus{
+		Target:   t.String(),
+		Chain:    t.chain.name,
+		Address:  t.address,
+		Decimals: t.decimals,
+		Paused:   t.paused,
+		Pending:  t.pending,
+	}
+	if !t.lastSent.IsZero() {
+		hash, sent := t.lastTx, t.lastSent
+		s.LastRound, s.LastTx, s.LastSent, s.LastStatus = t.lastRound, &hash, &sent, t.lastState
+	}
+	return s
+}
+
+// settled marks the transmission in progress as mined, failed or given up.
+func (t *aggregatorTarget) settled() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending--
+}
+
+// disableSigner stops using addr for this target.
+func (t *aggregatorTarget) disableSigner(addr common.Address) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.disabled == nil {
+		t.disabled = make(map[common.Address]bool)
+	}
+	t.disabled[addr] = true
+}
+
+// signerEnabled reports whether addr may transmit to this target: it must be
+// an aggregator signer and not have been rejected by the contract.
+func (t *aggregatorTarget) signerEnabled(addr common.Address) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.disabled[addr] && t.signers.authorized(addr)
+}
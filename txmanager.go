@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/core/types"
+	"github.com/classzz/go-classzz-v2/crypto"
+	"github.com/classzz/go-classzz-v2/log"
+	"github.com/classzz/go-classzz-v2/params"
+)
+
+const (
+	defaultTxTimeout   = 2 * time.Minute
+	defaultBumpPercent = 15
+	minBumpPercent     = 10 // replacement minimum of geth based nodes
+	defaultMaxBumps    = 3
+	receiptInterval    = 5 * time.Second
+	maxCappedTimeouts  = 5 // timeouts to wait at the fee cap before giving up
+)
+
+var (
+	errTxCancelled = errors.New("transaction replaced by cancellation")
+	errTxAbandoned = errors.New("transaction abandoned")
+	errFeeCapHit   = errors.New("fee caps leave no room for a replacement")
+	errTxReplaced  = errors.New("nonce used by another transaction")
+)
+
+// txs follows every broadcast transaction until it is mined.
+var txs = newTxManager()
+
+// trackedTx is a broadcast transaction and all replacements sent for its nonce.
+type trackedTx struct {
+	chain *evmChain
+	key   *ecdsa.PrivateKey
+	from  common.Address
+	done  func(*types.Receipt, error)
+
+	// Written only by the following goroutine, under mu.
+	mu       sync.Mutex
+	tx       *types.Transaction // latest version
+	hashes   []common.Hash      // every version broadcast for the nonce
+	bumps    int
+	cancel   bool // tx is the zero-value self-transfer replacing the original
+	capped   bool // the fee caps leave no room for another replacement
+	cappedAt time.Time
+	sentAt   time.Time
+}
+
+// txManager waits for receipts in the background. A transaction without a
+// receipt after the chain's timeout is rebroadcast with a bumped fee, and
+// after the configured number of bumps replaced by a zero-value transfer to
+// its sender, so a stuck nonce never blocks the signer for long. Once the fee
+// caps of the chain leave no room for a valid replacement, the manager keeps
+// waiting for the last version for a few more timeouts. A nonce the chain has
+// used without a receipt for any version ends tracking as replaced.
+type txManager struct {
+	mu      sync.Mutex
+	tracked map[common.Hash]*trackedTx // by hash of the first version
+}
+
+func newTxManager() *txManager {
+	return &txManager{tracked: make(map[common.Hash]*trackedTx)}
+}
+
+// track follows tx in its own goroutine and calls done with the receipt of
+// whichever version was mined, or with an error once the manager gives up.
+func (m *txManager) track(chain *evmChain, key *ecdsa.PrivateKey, tx *types.Transaction, done func(*types.Receipt, error)) {
+	t := &trackedTx{
+		chain:  chain,
+		key:    key,
+		from:   crypto.PubkeyToAddress(key.PublicKey),
+		tx:     tx,
+		hashes: []common.Hash{tx.Hash()},
+		sentAt: time.Now(),
+		done:   done,
+	}
+	m.mu.Lock()
+	m.tracked[tx.Hash()] = t
+	m.mu.Unlock()
+
+	go func() {
+		receipt, err := m.follow(t)
+		m.mu.Lock()
+		delete(m.tracked, t.hashes[0])
+		m.mu.Unlock()
+		if errors.Is(err, errTxAbandoned) || errors.Is(err, errTxReplaced) {
+			nonces.invalidate(chain.name, t.from)
+		}
+		nonces.done(chain.name, t.from, tx.Nonce())
+		if t.done != nil {
+			t.done(receipt, err)
+		}
+	}()
+}
+
+func (m *txManager) follow(t *trackedTx) (*types.Receipt, error) {
+	timeout, bumpPercent, maxBumps := t.chain.txTimeout, t.chain.bumpPercent, t.chain.maxBumps
+	for {
+		time.Sleep(receiptInterval)
+
+		if receipt := t.receipt(); receipt != nil {
+			if t.cancel && receipt.TxHash == t.tx.Hash() {
+				return receipt, errTxCancelled
+			}
+			if receipt.Status == types.ReceiptStatusFailed {
+				err := t.revertReason(receipt)
+				countRevert("receipt", err)
+				return receipt, err
+			}
+			return receipt, nil
+		}
+		if time.Since(t.sentAt) < timeout {
+			continue
+		}
+		if used, err := t.nonceUsed(); err != nil {
+			log.Debug("NonceAt", "chain", t.chain.name, "from", t.from, "err", err)
+		} else if used {
+			// Mined after the receipt check above, or replaced by another
+			// transaction of the signer.
+			if receipt := t.receipt(); receipt != nil {
+				continue
+			}
+			log.Warn("Nonce used by another transaction", "chain", t.chain.name, "from", t.from, "nonce", t.tx.Nonce(), "hashes", t.hashes)
+			return nil, errTxReplaced
+		}
+
+		switch {
+		case t.capped && time.Since(t.cappedAt) >= maxCappedTimeouts*timeout:
+			log.Error("Stuck transaction at fee cap, giving up", "chain", t.chain.name, "from", t.from, "nonce", t.tx.Nonce(), "hashes", t.hashes)
+			return nil, errTxAbandoned
+		case t.capped:
+			log.Warn("Stuck transaction at fee cap, still waiting", "chain", t.chain.name, "from", t.from, "nonce", t.tx.Nonce(), "hashes", t.hashes)
+			t.touch()
+		case t.cancel:
+			log.Error("Cancellation not mined, giving up", "chain", t.chain.name, "from", t.from, "nonce", t.tx.Nonce(), "hashes", t.hashes)
+			return nil, errTxAbandoned
+		case t.bumps < maxBumps:
+			err := t.replace(bumpPercent, false)
+			if errors.Is(err, errFeeCapHit) {
+				log.Warn("Cannot bump stuck transaction, waiting for it", "chain", t.chain.name, "from", t.from, "nonce", t.tx.Nonce(), "err", err)
+				t.holdAtCap()
+			} else if err != nil {
+				// Counts as a bump so a replacement the node keeps
+				// refusing ends in a cancellation.
+				log.Error("Rebroadcast failed", "chain", t.chain.name, "from", t.from, "nonce", t.tx.Nonce(), "err", err)
+				t.failedBump()
+			}
+		default:
+			err := t.replace(bumpPercent, true)
+			if errors.Is(err, errFeeCapHit) {
+				log.Warn("Cannot cancel stuck transaction, waiting for it", "chain", t.chain.name, "from", t.from, "nonce", t.tx.Nonce(), "err", err)
+				t.holdAtCap()
+			} else if err != nil {
+				log.Error("Cannot cancel stuck transaction", "chain", t.chain.name, "from", t.from, "nonce", t.tx.Nonce(), "err", err)
+				return nil, errTxAbandoned
+			}
+		}
+	}
+}
+
+// touch restarts the timeout of the current version.
+func (t *trackedTx) touch() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sentAt = time.Now()
+}
+
+// holdAtCap stops replacing the transaction and restarts its timeout.
+func (t *trackedTx) holdAtCap() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.capped, t.cappedAt, t.sentAt = true, now, now
+}
+
+// failedBump counts a refused replacement and restarts the timeout.
+func (t *trackedTx) failedBump() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bumps++
+	t.sentAt = time.Now()
+}
+
+// nonceUsed reports whether the chain has mined a transaction with the nonce
+// of t, whichever version it was.
+func (t *trackedTx) nonceUsed() (bool, error) {
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		return false, err
+	}
+	next, err := client.NonceAt(context.TODO(), t.from, nil)
+	if err != nil {
+		return false, err
+	}
+	return next > t.tx.Nonce(), nil
+}
+
+// receipt returns the receipt of any mined version of the transaction.
+func (t *trackedTx) receipt() *types.Receipt {
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		log.Error("TransactionReceipt", "chain", t.chain.name, "err", err)
+		return nil
+	}
+	for _, hash := range t.hashes {
+		receipt, err := client.TransactionReceipt(context.TODO(), hash)
+		if receipt != nil {
+			return receipt
+		}
+		if err != nil && err.Error() != "not found" {
+			log.Debug("TransactionReceipt", "chain", t.chain.name, "hash", hash, "err", err)
+		}
+	}
+	return nil
+}
+
+// revertReason replays the mined version of a failed transaction.
+func (t *trackedTx) revertReason(receipt *types.Receipt) error {
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		return &revertError{}
+	}
+	mined := t.tx
+	for _, hash := range t.hashes {
+		if hash == receipt.TxHash {
+			if tx, _, err := client.TransactionByHash(context.TODO(), hash); err == nil {
+				mined = tx
+			}
+		}
+	}
+	return replayRevert(context.TODO(), client, t.from, mined, receipt.BlockNumber)
+}
+
+// replace rebroadcasts the nonce with fees raised by percent. A cancel
+// replacement is a zero-value transfer to the sender.
+func (t *trackedTx) replace(percent int, cancel bool) error {
+	client, err := t.chain.pool.Client()
+	if err != nil {
+		return err
+	}
+	data, err := bumpTx(t.tx, percent, t.chain.maxFee, t.chain.maxTip)
+	if err != nil {
+		return err
+	}
+	if cancel {
+		setCancel(data, t.from)
+	}
+	signed, err := types.SignTx(types.NewTx(data), types.LatestSignerForChainID(t.chain.id), t.key)
+	if err != nil {
+		return err
+	}
+	if err := client.SendTransaction(context.TODO(), signed); err != nil && !isKnownTx(err) {
+		return err
+	}
+	t.mu.Lock()
+	t.tx, t.cancel, t.sentAt = signed, cancel, time.Now()
+	t.hashes = append(t.hashes, signed.Hash())
+	if !cancel {
+		t.bumps++
+	}
+	t.mu.Unlock()
+	nonces.replaced(t.chain.name, t.from, signed.Nonce(), signed.Hash())
+
+	if cancel {
+		log.Warn("Cancelling stuck transaction", "chain", t.chain.name, "from", t.from, "nonce", signed.Nonce(), "hash", signed.Hash())
+	} else {
+		log.Warn("Bumped stuck transaction", "chain", t.chain.name, "from", t.from, "nonce", signed.Nonce(), "hash", signed.Hash(), "bump", t.bumps)
+	}
+	return nil
+}
+
+// bumpTx copies tx with every fee field raised by percent. Fees are limited
+// to maxFee and maxTip; if that leaves a field below the replacement minimum
+// of the node, errFeeCapHit is returned.
+func bumpTx(tx *types.Transaction, percent int, maxFee, maxTip *big.Int) (types.TxData, error) {
+	bump := func(name string, v, limit *big.Int) (*big.Int, error) {
+		r := percentOf(v, 100+percent)
+		if r.Cmp(v) <= 0 {
+			r.Add(v, big.NewInt(1))
+		}
+		if limit != nil && r.Cmp(limit) > 0 {
+			r = new(big.Int).Set(limit)
+		}
+		if min := percentOf(v, 100+minBumpPercent); r.Cmp(min) < 0 || r.Cmp(v) <= 0 {
+			return nil, fmt.Errorf("%w: %s %v cannot reach the replacement minimum %v", errFeeCapHit, name, v, min)
+		}
+		return r, nil
+	}
+	if tx.Type() == types.DynamicFeeTxType {
+		feeCap, err := bump("fee cap", tx.GasFeeCap(), maxFee)
+		if err != nil {
+			return nil, err
+		}
+		tipLimit := feeCap
+		if maxTip != nil && maxTip.Cmp(tipLimit) < 0 {
+			tipLimit = maxTip
+		}
+		tipCap, err := bump("tip cap", tx.GasTipCap(), tipLimit)
+		if err != nil {
+			return nil, err
+		}
+		return &types.DynamicFeeTx{
+			ChainID:   tx.ChainId(),
+			Nonce:     tx.Nonce(),
+			GasTipCap: tipCap,
+			GasFeeCap: feeCap,
+			Gas:       tx.Gas(),
+			To:        tx.To(),
+			Value:     tx.Value(),
+			Data:      tx.Data(),
+		}, nil
+	}
+	price, err := bump("gas price", tx.GasPrice(), maxFee)
+	if err != nil {
+		return nil, err
+	}
+	return &types.LegacyTx{
+		Nonce:    tx.Nonce(),
+		GasPrice: price,
+		Gas:      tx.Gas(),
+		To:       tx.To(),
+		Value:    tx.Value(),
+		Data:     tx.Data(),
+	}, nil
+}
+
+// setCancel turns a transaction into a zero-value transfer to from.
+func setCancel(data types.TxData, from common.Address) {
+	switch d := data.(type) {
+	case *types.DynamicFeeTx:
+		d.To, d.Value, d.Data, d.Gas = &from, new(big.Int), nil, params.TxGas
+	case *types.LegacyTx:
+		d.To, d.Value, d.Data, d.Gas = &from, new(big.Int), nil, params.TxGas
+	}
+}
+
+// trackedState is a snapshot of one tracked transaction for debugging.
+type trackedState struct {
+	Chain  string         `json:"chain"`
+	From   common.Address `json:"from"`
+	Nonce  uint64         `json:"nonce"`
+	Hashes []common.Hash  `json:"hashes"`
+	Bumps  int            `json:"bumps"`
+	Cancel bool           `json:"cancel"`
+}
+
+// snapshot returns the transactions currently followed.
+func (m *txManager) snapshot() []trackedState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make([]trackedState, 0, len(m.tracked))
+	for _, t := range m.tracked {
+		t.mu.Lock()
+		states = append(states, trackedState{
+			Chain:  t.chain.name,
+			From:   t.from,
+			Nonce:  t.tx.Nonce(),
+			Hashes: append([]common.Hash(nil), t.hashes...),
+			Bumps:  t.bumps,
+			Cancel: t.cancel,
+		})
+		t.mu.Unlock()
+	}
+	return states
+}
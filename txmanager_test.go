@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/classzz/go-classzz-v2/common"
+	"github.com/classzz/go-classzz-v2/core/types"
+)
+
+func dynamicTx(feeCap, tipCap int64) *types.Transaction {
+	to := common.Address{1}
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   big.NewInt(1),
+		Nonce:     7,
+		GasFeeCap: big.NewInt(feeCap),
+		GasTipCap: big.NewInt(tipCap),
+		Gas:       100000,
+		To:        &to,
+		Value:     new(big.Int),
+	})
+}
+
+func legacyTx(price int64) *types.Transaction {
+	to := common.Address{1}
+	return types.NewTx(&types.LegacyTx{Nonce: 7, GasPrice: big.NewInt(price), Gas: 100000, To: &to, Value: new(big.Int)})
+}
+
+func TestBumpTx(t *testing.T) {
+	bigOrNil := func(v int64) *big.Int {
+		if v == 0 {
+			return nil
+		}
+		return big.NewInt(v)
+	}
+	tests := []struct {
+		name           string
+		tx             *types.Transaction
+		percent        int
+		maxFee, maxTip int64 // 0 is unlimited
+		feeCap, tipCap int64 // gas price for legacy transactions
+		capHit         bool
+	}{
+		{"dynamic bump", dynamicTx(1000, 100), 15, 0, 0, 1150, 115, false},
+		{"dynamic below replacement minimum", dynamicTx(1000, 100), 5, 0, 0, 1050, 105, true},
+		{"dynamic exactly at replacement minimum", dynamicTx(1000, 100), 10, 0, 0, 1100, 110, false},
+		{"fee cap clamped to max fee", dynamicTx(1000, 100), 50, 1200, 0, 1200, 150, false},
+		{"max fee below replacement minimum", dynamicTx(1000, 100), 15, 1050, 0, 0, 0, true},
+		{"tip clamped to max tip", dynamicTx(1000, 100), 50, 0, 120, 1500, 120, false},
+		{"max tip below replacement minimum", dynamicTx(1000, 100), 15, 0, 105, 0, 0, true},
+		{"tip limited by bumped fee cap", dynamicTx(1000, 1000), 15, 1100, 0, 1100, 1100, false},
+		{"legacy bump", legacyTx(1000), 20, 0, 0, 1200, 0, false},
+		{"legacy clamped to max fee", legacyTx(1000), 20, 1100, 0, 1100, 0, false},
+		{"legacy at max fee", legacyTx(1000), 20, 1000, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		data, err := bumpTx(tt.tx, tt.percent, bigOrNil(tt.maxFee), bigOrNil(tt.maxTip))
+		if tt.capHit {
+			if !errors.Is(err, errFeeCapHit) {
+				t.Errorf("%s: err %v, want %v", tt.name, err, errFeeCapHit)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		bumped := types.NewTx(data)
+		if bumped.Nonce() != tt.tx.Nonce() || bumped.Gas() != tt.tx.Gas() || *bumped.To() != *tt.tx.To() {
+			t.Errorf("%s: replacement changed nonce, gas or recipient", tt.name)
+		}
+		if tt.tx.Type() == types.LegacyTxType {
+			if bumped.GasPrice().Int64() != tt.feeCap {
+				t.Errorf("%s: gas price %v, want %d", tt.name, bumped.GasPrice(), tt.feeCap)
+			}
+			continue
+		}
+		if bumped.GasFeeCap().Int64() != tt.feeCap || bumped.GasTipCap().Int64() != tt.tipCap {
+			t.Errorf("%s: fee cap %v tip %v, want %d and %d", tt.name, bumped.GasFeeCap(), bumped.GasTipCap(), tt.feeCap, tt.tipCap)
+		}
+	}
+}